@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/plumber-cd/terraform-backend-git/types"
 )
@@ -37,6 +38,14 @@ func GetStorageClient(metadata *types.RequestMetadata) (types.StorageClient, err
 	return nil, fmt.Errorf("Unknown storage type %s", metadata.Type)
 }
 
+// setLockInfo remembers which lock is held on the state, and tells the storage if it wants to know.
+func setLockInfo(metadata *types.RequestMetadata, lockInfo *types.LockInfo) {
+	metadata.LockInfo = lockInfo
+	if receiver, ok := metadata.Params.(types.LockInfoReceiver); ok {
+		receiver.SetLockInfo(lockInfo)
+	}
+}
+
 // lockedByMe trying to read the lock from the storage and check if it's locked by the requestor.
 // ReadStateLock implementations must return ErrLockMissing if it didn't exist.
 func lockedByMe(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
@@ -51,6 +60,7 @@ func lockedByMe(metadata *types.RequestMetadata, storageClient types.StorageClie
 	}
 
 	if metadata.ID == lockInfo.ID {
+		setLockInfo(metadata, &lockInfo)
 		return nil
 	}
 
@@ -63,18 +73,50 @@ func lockedByMe(metadata *types.RequestMetadata, storageClient types.StorageClie
 // LockState will lock the state as requested.
 // Locking must be atomic operation so leave all checks for the client.
 // Client implementations must return ErrLockingConflict if it was already locked by someone else.
-func LockState(metadata *types.RequestMetadata, storageClient types.StorageClient, body []byte) error {
-	if err := storageClient.LockState(metadata.Params, body); err != nil {
-		// If it was a conflict, using lockedByMe here will return an ErrLocked since lock ID was missing in the request
-		if err == types.ErrLockingConflict {
-			if err := lockedByMe(metadata, storageClient); err != nil {
-				return err
-			}
+// If lock TTL was set and the existing lock is stale, it will be released and locking attempted once again.
+// Conflicts are only sent to webhooks when the conflicting lock changes, as Terraform retries the lock with -lock-timeout.
+func LockState(metadata *types.RequestMetadata, storageClient types.StorageClient, body []byte) (err error) {
+	var lockInfo types.LockInfo
+	if err := json.Unmarshal(body, &lockInfo); err == nil {
+		setLockInfo(metadata, &lockInfo)
+	}
+
+	defer func() {
+		if err == nil {
+			forgetConflict(metadata)
+			notify(types.EventLockAcquired, metadata, nil)
+		} else if errLocked, ok := err.(*types.ErrLocked); ok {
+			notifyConflict(metadata, errLocked.LockInfo)
+		} else if err == types.ErrLockingConflict {
+			notifyConflict(metadata, nil)
 		}
+	}()
+
+	err = storageClient.LockState(metadata.Params, body)
+	if err != types.ErrLockingConflict {
 		return err
 	}
 
-	return nil
+	// If it was a conflict, using lockedByMe here will return an ErrLocked since lock ID was missing in the request
+	err = lockedByMe(metadata, storageClient)
+	if errLocked, ok := err.(*types.ErrLocked); ok && isStale(errLocked.LockInfo, lockTTL(), time.Now()) {
+		if err := releaseStaleLock(metadata, storageClient, errLocked.LockInfo); err != nil {
+			return err
+		}
+		// Releasing it told the storage about the stale lock
+		setLockInfo(metadata, &lockInfo)
+
+		if err := storageClient.LockState(metadata.Params, body); err != types.ErrLockingConflict {
+			return err
+		}
+
+		err = lockedByMe(metadata, storageClient)
+	}
+	if err != nil {
+		return err
+	}
+
+	return types.ErrLockingConflict
 }
 
 // UnLockState will unlock the state as requested.
@@ -93,6 +135,7 @@ func UnLockState(metadata *types.RequestMetadata, storageClient types.StorageCli
 	See issue https://github.com/hashicorp/terraform/issues/28421.
 	Unlock function in HTTP TF backend does not using lockID.
 	Our backend would never know the ID to unlock when force-unlock was used.
+	Please use "terraform-backend-git unlock LOCK_ID" or the /unlock endpoint instead.
 	` + storageClient.ForceUnLockWorkaroundMessage(metadata.Params))
 			}
 			return err
@@ -106,10 +149,17 @@ func UnLockState(metadata *types.RequestMetadata, storageClient types.StorageCli
 		return err
 	}
 
+	return releaseLock(metadata, storageClient)
+}
+
+// releaseLock unlocks the state, it must be known to be locked by the requestor.
+func releaseLock(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
 	if err := storageClient.UnLockState(metadata.Params); err != nil {
 		return err
 	}
 
+	notify(types.EventLockReleased, metadata, nil)
+
 	return nil
 }
 
@@ -145,6 +195,8 @@ func UpdateState(metadata *types.RequestMetadata, storageClient types.StorageCli
 		return err
 	}
 
+	notify(types.EventStateUpdated, metadata, nil)
+
 	return nil
 }
 
@@ -159,5 +211,7 @@ func DeleteState(metadata *types.RequestMetadata, storageClient types.StorageCli
 		return err
 	}
 
+	notify(types.EventStateDeleted, metadata, nil)
+
 	return nil
 }
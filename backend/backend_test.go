@@ -0,0 +1,266 @@
+package backend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// testParams addresses a state in testStorage
+type testParams struct {
+	state string
+}
+
+func (params *testParams) String() string {
+	return params.state
+}
+
+// testStorage is an in-memory storage keeping every version of every state, revision is the index of the version.
+// Deleted state is recorded as a nil version.
+type testStorage struct {
+	locks    map[string][]byte
+	versions map[string][][]byte
+}
+
+func newTestStorage() *testStorage {
+	return &testStorage{
+		locks:    make(map[string][]byte),
+		versions: make(map[string][][]byte),
+	}
+}
+
+func newTestMetadata(state string) *types.RequestMetadata {
+	return &types.RequestMetadata{Type: "test", Params: &testParams{state: state}}
+}
+
+func (storage *testStorage) ParseMetadataParams(*http.Request, *types.RequestMetadata) error {
+	return nil
+}
+
+func (storage *testStorage) Connect(types.RequestMetadataParams) error {
+	return nil
+}
+
+func (storage *testStorage) Disconnect(types.RequestMetadataParams) {}
+
+func (storage *testStorage) LockState(p types.RequestMetadataParams, lock []byte) error {
+	state := p.(*testParams).state
+	if _, ok := storage.locks[state]; ok {
+		return types.ErrLockingConflict
+	}
+
+	storage.locks[state] = lock
+	return nil
+}
+
+func (storage *testStorage) ReadStateLock(p types.RequestMetadataParams) ([]byte, error) {
+	lock, ok := storage.locks[p.(*testParams).state]
+	if !ok {
+		return nil, types.ErrLockMissing
+	}
+
+	return lock, nil
+}
+
+func (storage *testStorage) UnLockState(p types.RequestMetadataParams) error {
+	delete(storage.locks, p.(*testParams).state)
+	return nil
+}
+
+func (storage *testStorage) ForceUnLockWorkaroundMessage(types.RequestMetadataParams) string {
+	return ""
+}
+
+func (storage *testStorage) GetState(p types.RequestMetadataParams) ([]byte, error) {
+	versions := storage.versions[p.(*testParams).state]
+	if len(versions) == 0 || versions[len(versions)-1] == nil {
+		return nil, types.ErrStateDidNotExisted
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+func (storage *testStorage) UpdateState(p types.RequestMetadataParams, state []byte) error {
+	storage.versions[p.(*testParams).state] = append(storage.versions[p.(*testParams).state], state)
+	return nil
+}
+
+func (storage *testStorage) DeleteState(p types.RequestMetadataParams) error {
+	if _, err := storage.GetState(p); err != nil {
+		return err
+	}
+
+	storage.versions[p.(*testParams).state] = append(storage.versions[p.(*testParams).state], nil)
+	return nil
+}
+
+func (storage *testStorage) ListStateVersions(p types.RequestMetadataParams) ([]types.StateVersion, error) {
+	versions := storage.versions[p.(*testParams).state]
+
+	list := make([]types.StateVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		list = append(list, types.StateVersion{Revision: strconv.Itoa(i)})
+	}
+
+	return list, nil
+}
+
+func (storage *testStorage) GetStateVersion(p types.RequestMetadataParams, revision string) ([]byte, error) {
+	versions := storage.versions[p.(*testParams).state]
+
+	i, err := strconv.Atoi(revision)
+	if err != nil || i < 0 || i >= len(versions) {
+		return nil, types.ErrRevisionNotFound
+	}
+	if versions[i] == nil {
+		return nil, types.ErrStateDidNotExisted
+	}
+
+	return versions[i], nil
+}
+
+func (storage *testStorage) ListStateLocks(types.RequestMetadataParams) (map[string][]byte, error) {
+	locks := make(map[string][]byte, len(storage.locks))
+	for state, lock := range storage.locks {
+		locks[state] = lock
+	}
+
+	return locks, nil
+}
+
+func (storage *testStorage) ParamsForState(_ types.RequestMetadataParams, state string) types.RequestMetadataParams {
+	return &testParams{state: state}
+}
+
+// lockBody makes Terraform lock metadata with this ID, created at the given time
+func lockBody(t *testing.T, id string, created time.Time) []byte {
+	t.Helper()
+
+	lock, err := json.Marshal(&types.LockInfo{ID: id, Who: "test", Created: created})
+	if err != nil {
+		t.Fatalf("marshal lock: %v", err)
+	}
+
+	return lock
+}
+
+// readSerialLineage reads serial and lineage of the Terraform state
+func readSerialLineage(t *testing.T, state []byte) (uint64, string) {
+	t.Helper()
+
+	s, err := parseTFState(state)
+	if err != nil {
+		t.Fatalf("parse state: %v", err)
+	}
+
+	return s.Serial, s.Lineage
+}
+
+func TestRollbackState(t *testing.T) {
+	storage := newTestStorage()
+	metadata := newTestMetadata("state.json")
+
+	for _, state := range []string{
+		`{"version":4,"serial":1,"lineage":"abc","outputs":{"v":{"value":"1","type":"string"}}}`,
+		`{"version":4,"serial":2,"lineage":"abc","outputs":{"v":{"value":"2","type":"string"}}}`,
+		`{"version":4,"serial":5,"lineage":"abc","outputs":{"v":{"value":"3","type":"string"}}}`,
+	} {
+		storage.versions["state.json"] = append(storage.versions["state.json"], []byte(state))
+	}
+
+	if err := RollbackState(metadata, storage, "0"); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+
+	state, err := GetState(metadata, storage)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if serial, lineage := readSerialLineage(t, state); serial != 6 || lineage != "abc" {
+		t.Fatalf("expected serial 6 and lineage abc, got %d and %s", serial, lineage)
+	}
+	if diff, err := diffTFState(storage.versions["state.json"][0], state); err != nil || len(diff.OutputsChanged) != 0 {
+		t.Fatalf("expected outputs of the first version, got %+v (%v)", diff, err)
+	}
+
+	// Lock acquired for the rollback must be released
+	if len(storage.locks) != 0 {
+		t.Fatalf("expected no locks to be left behind, got %q", storage.locks)
+	}
+
+	if err := RollbackState(metadata, storage, "42"); err != types.ErrRevisionNotFound {
+		t.Fatalf("expected ErrRevisionNotFound, got %v", err)
+	}
+}
+
+func TestRollbackState_Locked(t *testing.T) {
+	storage := newTestStorage()
+	storage.versions["state.json"] = [][]byte{[]byte(`{"serial":1}`), []byte(`{"serial":2}`)}
+
+	if err := storage.LockState(&testParams{state: "state.json"}, lockBody(t, "mine", time.Now())); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	// Someone else's lock is respected
+	if err := RollbackState(newTestMetadata("state.json"), storage, "0"); err == nil {
+		t.Fatal("expected rollback to fail while someone else holds the lock")
+	}
+	if len(storage.versions["state.json"]) != 2 {
+		t.Fatalf("expected state to stay as-is, got %d versions", len(storage.versions["state.json"]))
+	}
+
+	// Lock held by the caller is used and stays in place
+	metadata := newTestMetadata("state.json")
+	metadata.ID = "mine"
+	if err := RollbackState(metadata, storage, "0"); err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if _, ok := storage.locks["state.json"]; !ok {
+		t.Fatal("expected lock held by the caller to stay in place")
+	}
+
+	state, err := storage.GetState(metadata.Params)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if serial, _ := readSerialLineage(t, state); serial != 3 {
+		t.Fatalf("expected serial 3, got %d", serial)
+	}
+}
+
+func TestBumpSerial(t *testing.T) {
+	tests := []struct {
+		name, state, current string
+		serial               uint64
+		lineage              string
+		asIs                 bool
+	}{
+		{name: "bumped past current", state: `{"serial":1,"lineage":"abc"}`, current: `{"serial":7,"lineage":"abc"}`, serial: 8, lineage: "abc"},
+		{name: "lineage kept", state: `{"serial":1,"lineage":"old"}`, current: `{"serial":1,"lineage":"new"}`, serial: 2, lineage: "old"},
+		{name: "current is older", state: `{"serial":9,"lineage":"abc"}`, current: `{"serial":3,"lineage":"abc"}`, serial: 4, lineage: "abc"},
+		{name: "no current state", state: `{"serial":1}`, current: ``, asIs: true},
+		{name: "current without serial", state: `{"serial":1}`, current: `{}`, asIs: true},
+		{name: "state without serial", state: `{"lineage":"abc"}`, current: `{"serial":1}`, asIs: true},
+		{name: "not a state", state: `not json`, current: `{"serial":1}`, asIs: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bumped := bumpSerial([]byte(test.state), []byte(test.current))
+			if test.asIs {
+				if string(bumped) != test.state {
+					t.Fatalf("expected state as-is, got %s", bumped)
+				}
+				return
+			}
+
+			if serial, lineage := readSerialLineage(t, bumped); serial != test.serial || lineage != test.lineage {
+				t.Fatalf("expected serial %d and lineage %s, got %d and %s", test.serial, test.lineage, serial, lineage)
+			}
+		})
+	}
+}
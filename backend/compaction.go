@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// getStateHistoryCompactor checks if storage client can compact the history.
+func getStateHistoryCompactor(storageClient types.StorageClient) (types.StateHistoryCompactor, error) {
+	compactor, ok := storageClient.(types.StateHistoryCompactor)
+	if !ok {
+		return nil, types.ErrNotSupported
+	}
+
+	return compactor, nil
+}
+
+// CompactStateHistory drops old versions of the states selected by the policy from the storage history.
+// Every state that would lose versions is locked while the history is rewritten, and if any of them was already locked - nothing is done.
+// With dryRun, it only tells what would be done.
+// Returns ErrNotSupported if storage type does not keep the history.
+func CompactStateHistory(metadata *types.RequestMetadata, storageClient types.StorageClient, policy types.CompactionPolicy, dryRun bool) (*types.CompactionPlan, error) {
+	if policy.Keep < 0 {
+		return nil, errors.New("Number of versions to keep can't be negative")
+	}
+	if policy.Keep == 0 && policy.Since.IsZero() {
+		return nil, errors.New("Either number of versions to keep or the cutoff time is required to compact the history")
+	}
+	if len(policy.States) == 0 {
+		return nil, errors.New("States to compact are required to compact the history")
+	}
+
+	compactor, err := getStateHistoryCompactor(storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := compactor.PlanStateHistoryCompaction(metadata.Params, policy)
+	if err != nil || dryRun || len(plan.States) == 0 {
+		return plan, err
+	}
+
+	lockInfo, err := newLockInfo("compact", "Compacting history at "+plan.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := json.Marshal(lockInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := make([]*types.RequestMetadata, 0, len(plan.States))
+	defer func() {
+		for _, stateMetadata := range locked {
+			if err := releaseLock(stateMetadata, storageClient); err != nil {
+				log.Printf("Failed to release lock %s on %s: %s", lockInfo.ID, stateMetadata.Params.String(), err)
+			}
+		}
+	}()
+
+	for _, state := range plan.States {
+		stateMetadata := &types.RequestMetadata{
+			Type:   metadata.Type,
+			Params: compactor.ParamsForState(metadata.Params, state.State),
+		}
+		if err := LockState(stateMetadata, storageClient, lock); err != nil {
+			return nil, fmt.Errorf("Failed to lock %s: %w", state.State, err)
+		}
+		locked = append(locked, stateMetadata)
+	}
+
+	return compactor.CompactStateHistory(metadata.Params, plan)
+}
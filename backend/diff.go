@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// DiffState compares two versions of the state, decrypting them if needed.
+// Empty to revision means the current state.
+// State that didn't exist at the revision is compared as an empty state.
+// Returns ErrNotSupported if storage type does not keep the history.
+func DiffState(metadata *types.RequestMetadata, storageClient types.StorageClient, from, to string) (*types.StateDiff, error) {
+	fromState, err := GetStateVersion(metadata, storageClient, from)
+	if err != nil && err != types.ErrStateDidNotExisted {
+		return nil, err
+	}
+
+	var toState []byte
+	if to == "" {
+		toState, err = GetState(metadata, storageClient)
+	} else {
+		toState, err = GetStateVersion(metadata, storageClient, to)
+	}
+	if err != nil && err != types.ErrStateDidNotExisted {
+		return nil, err
+	}
+
+	diff, err := diffTFState(fromState, toState)
+	if err != nil {
+		return nil, err
+	}
+
+	diff.From = from
+	diff.To = to
+
+	return diff, nil
+}
+
+// diffTFState compares two Terraform states
+func diffTFState(from, to []byte) (*types.StateDiff, error) {
+	fromState, err := parseTFState(from)
+	if err != nil {
+		return nil, err
+	}
+
+	toState, err := parseTFState(to)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &types.StateDiff{
+		FromSerial:       fromState.Serial,
+		ToSerial:         toState.Serial,
+		FromLineage:      fromState.Lineage,
+		ToLineage:        toState.Lineage,
+		ResourcesAdded:   []string{},
+		ResourcesRemoved: []string{},
+		ResourcesChanged: []types.ResourceChange{},
+		OutputsAdded:     []string{},
+		OutputsRemoved:   []string{},
+		OutputsChanged:   []string{},
+	}
+
+	fromInstances := fromState.instances()
+	toInstances := toState.instances()
+
+	for address, toAttributes := range toInstances {
+		fromAttributes, ok := fromInstances[address]
+		if !ok {
+			diff.ResourcesAdded = append(diff.ResourcesAdded, address)
+			continue
+		}
+
+		if changed := diffAttributes(fromAttributes, toAttributes); len(changed) > 0 {
+			diff.ResourcesChanged = append(diff.ResourcesChanged, types.ResourceChange{
+				Address:    address,
+				Attributes: changed,
+			})
+		}
+	}
+
+	for address := range fromInstances {
+		if _, ok := toInstances[address]; !ok {
+			diff.ResourcesRemoved = append(diff.ResourcesRemoved, address)
+		}
+	}
+
+	for name, toOutput := range toState.Outputs {
+		fromOutput, ok := fromState.Outputs[name]
+		if !ok {
+			diff.OutputsAdded = append(diff.OutputsAdded, name)
+			continue
+		}
+
+		if !jsonEqual(fromOutput.Value, toOutput.Value) || !jsonEqual(fromOutput.Type, toOutput.Type) {
+			diff.OutputsChanged = append(diff.OutputsChanged, name)
+		}
+	}
+
+	for name := range fromState.Outputs {
+		if _, ok := toState.Outputs[name]; !ok {
+			diff.OutputsRemoved = append(diff.OutputsRemoved, name)
+		}
+	}
+
+	sort.Strings(diff.ResourcesAdded)
+	sort.Strings(diff.ResourcesRemoved)
+	sort.Slice(diff.ResourcesChanged, func(i, j int) bool {
+		return diff.ResourcesChanged[i].Address < diff.ResourcesChanged[j].Address
+	})
+	sort.Strings(diff.OutputsAdded)
+	sort.Strings(diff.OutputsRemoved)
+	sort.Strings(diff.OutputsChanged)
+
+	return diff, nil
+}
+
+// diffAttributes returns sorted names of attributes that are different
+func diffAttributes(from, to map[string]json.RawMessage) []string {
+	changed := make([]string, 0)
+
+	for name, toValue := range to {
+		if fromValue, ok := from[name]; !ok || !jsonEqual(fromValue, toValue) {
+			changed = append(changed, name)
+		}
+	}
+
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+
+	return changed
+}
@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+func TestDiffTFState(t *testing.T) {
+	const base = `{
+		"serial": 1,
+		"lineage": "abc",
+		"outputs": {
+			"name": {"value": "foo", "type": "string"},
+			"ids": {"value": ["a", "b"], "type": ["list", "string"]}
+		},
+		"resources": [
+			{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+				{"index_key": 0, "attributes": {"id": "i-1", "tags": {"a": "1", "b": "2"}}},
+				{"index_key": 1, "attributes": {"id": "i-2"}}
+			]},
+			{"module": "module.net", "mode": "data", "type": "aws_vpc", "name": "main", "instances": [
+				{"attributes": {"id": "vpc-1"}}
+			]}
+		]
+	}`
+
+	tests := []struct {
+		name, from, to string
+		expected       *types.StateDiff
+	}{
+		{
+			name: "unchanged",
+			from: base,
+			// Formatting and keys order do not matter
+			to: `{"lineage": "abc", "serial": 2,
+				"outputs": {"ids": {"type": ["list", "string"], "value": ["a", "b"]}, "name": {"type": "string", "value": "foo"}},
+				"resources": [
+					{"module": "module.net", "mode": "data", "type": "aws_vpc", "name": "main", "instances": [{"attributes": {"id": "vpc-1"}}]},
+					{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+						{"index_key": 1, "attributes": {"id": "i-2"}},
+						{"index_key": 0, "attributes": {"tags": {"b": "2", "a": "1"}, "id": "i-1"}}
+					]}
+				]}`,
+			expected: &types.StateDiff{FromSerial: 1, ToSerial: 2, FromLineage: "abc", ToLineage: "abc"},
+		},
+		{
+			name: "added",
+			from: `{"serial": 1, "lineage": "abc"}`,
+			to:   base,
+			expected: &types.StateDiff{
+				FromSerial: 1, ToSerial: 1, FromLineage: "abc", ToLineage: "abc",
+				ResourcesAdded: []string{"aws_instance.web[0]", "aws_instance.web[1]", "module.net.data.aws_vpc.main"},
+				OutputsAdded:   []string{"ids", "name"},
+			},
+		},
+		{
+			name: "removed",
+			from: base,
+			to:   "",
+			expected: &types.StateDiff{
+				FromSerial: 1, FromLineage: "abc",
+				ResourcesRemoved: []string{"aws_instance.web[0]", "aws_instance.web[1]", "module.net.data.aws_vpc.main"},
+				OutputsRemoved:   []string{"ids", "name"},
+			},
+		},
+		{
+			name: "changed",
+			from: base,
+			to: `{
+				"serial": 2,
+				"lineage": "abc",
+				"outputs": {
+					"name": {"value": "bar", "type": "string"},
+					"ids": {"value": ["a", "b"], "type": ["set", "string"]}
+				},
+				"resources": [
+					{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+						{"index_key": 0, "attributes": {"id": "i-1", "tags": {"a": "1"}, "ami": "ami-1"}},
+						{"index_key": 1, "attributes": {}}
+					]},
+					{"module": "module.net", "mode": "data", "type": "aws_vpc", "name": "main", "instances": [
+						{"attributes": {"id": "vpc-1"}}
+					]}
+				]
+			}`,
+			expected: &types.StateDiff{
+				FromSerial: 1, ToSerial: 2, FromLineage: "abc", ToLineage: "abc",
+				ResourcesChanged: []types.ResourceChange{
+					{Address: "aws_instance.web[0]", Attributes: []string{"ami", "tags"}},
+					{Address: "aws_instance.web[1]", Attributes: []string{"id"}},
+				},
+				OutputsChanged: []string{"ids", "name"},
+			},
+		},
+		{
+			name: "deposed",
+			from: `{"resources": [{"mode": "managed", "type": "null_resource", "name": "a", "instances": [{"attributes": {"id": "1"}}]}]}`,
+			to: `{"resources": [{"mode": "managed", "type": "null_resource", "name": "a", "instances": [
+				{"attributes": {"id": "2"}},
+				{"deposed": "00000001", "attributes": {"id": "1"}}
+			]}]}`,
+			expected: &types.StateDiff{
+				ResourcesAdded:   []string{"null_resource.a (deposed 00000001)"},
+				ResourcesChanged: []types.ResourceChange{{Address: "null_resource.a", Attributes: []string{"id"}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff, err := diffTFState([]byte(test.from), []byte(test.to))
+			if err != nil {
+				t.Fatalf("diff: %v", err)
+			}
+
+			expected := *test.expected
+			for _, list := range []*[]string{&expected.ResourcesAdded, &expected.ResourcesRemoved, &expected.OutputsAdded, &expected.OutputsRemoved, &expected.OutputsChanged} {
+				if *list == nil {
+					*list = []string{}
+				}
+			}
+			if expected.ResourcesChanged == nil {
+				expected.ResourcesChanged = []types.ResourceChange{}
+			}
+
+			if !reflect.DeepEqual(diff, &expected) {
+				t.Fatalf("expected %+v, got %+v", expected, *diff)
+			}
+		})
+	}
+}
+
+func TestDiffTFState_NotAState(t *testing.T) {
+	if _, err := diffTFState([]byte(`{}`), []byte(`not json`)); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"fmt"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// getStateHistoryReader checks if storage client keeps the state history.
+func getStateHistoryReader(storageClient types.StorageClient) (types.StateHistoryReader, error) {
+	historyReader, ok := storageClient.(types.StateHistoryReader)
+	if !ok {
+		return nil, types.ErrNotSupported
+	}
+
+	return historyReader, nil
+}
+
+// GetStateHistory lists versions of the state, most recent first.
+// Returns ErrNotSupported if storage type does not keep the history.
+func GetStateHistory(metadata *types.RequestMetadata, storageClient types.StorageClient) ([]types.StateVersion, error) {
+	historyReader, err := getStateHistoryReader(storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	return historyReader.ListStateVersions(metadata.Params)
+}
+
+// GetStateVersion reads the state as it was at the given revision, decrypting it if needed.
+// Returns ErrNotSupported if storage type does not keep the history.
+func GetStateVersion(metadata *types.RequestMetadata, storageClient types.StorageClient, revision string) ([]byte, error) {
+	historyReader, err := getStateHistoryReader(storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := historyReader.GetStateVersion(metadata.Params, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	return decryptIfEnabled(state)
+}
+
+// RollbackState restores the state to what it was at the given revision, as a new version of the state.
+// The state serial is bumped over the current one, so Terraform doesn't consider restored state stale.
+// Restored state is encrypted again with the current encryption settings.
+func RollbackState(metadata *types.RequestMetadata, storageClient types.StorageClient, revision string) error {
+	return withLock(metadata, storageClient, "rollback", "Rollback to "+revision, func() error {
+		state, err := GetStateVersion(metadata, storageClient, revision)
+		if err != nil {
+			if err == types.ErrStateDidNotExisted {
+				return fmt.Errorf("State did not exist at revision %s", revision)
+			}
+			return err
+		}
+
+		current, err := GetState(metadata, storageClient)
+		if err != nil && err != types.ErrStateDidNotExisted {
+			return err
+		}
+
+		return UpdateState(metadata, storageClient, bumpSerial(state, current))
+	})
+}
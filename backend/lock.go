@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// newLockInfo creates lock metadata for operations the backend performs on its own, outside of Terraform.
+func newLockInfo(operation, info string) (*types.LockInfo, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	who := "terraform-backend-git"
+	if u, err := user.Current(); err == nil {
+		who = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		who += "@" + host
+	}
+
+	return &types.LockInfo{
+		ID:        fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+		Operation: operation,
+		Info:      info,
+		Who:       who,
+		Version:   "terraform-backend-git",
+		Created:   time.Now().UTC(),
+	}, nil
+}
+
+// withLock runs fn while holding the lock on the state.
+// If the request already had a lock ID - the state must be locked with it, and it stays locked afterwards.
+// Otherwise a new lock is acquired for the duration of fn, and the request will carry it's ID while fn runs.
+func withLock(metadata *types.RequestMetadata, storageClient types.StorageClient, operation, info string, fn func() error) error {
+	if metadata.ID != "" {
+		if err := lockedByMe(metadata, storageClient); err != nil {
+			return err
+		}
+
+		return fn()
+	}
+
+	lockInfo, err := newLockInfo(operation, info)
+	if err != nil {
+		return err
+	}
+
+	lock, err := json.Marshal(lockInfo)
+	if err != nil {
+		return err
+	}
+
+	if err := LockState(metadata, storageClient, lock); err != nil {
+		return err
+	}
+
+	metadata.ID = lockInfo.ID
+	defer func() {
+		if err := releaseLock(metadata, storageClient); err != nil {
+			log.Printf("Failed to release lock %s on %s: %s", lockInfo.ID, metadata.Params.String(), err)
+		}
+		metadata.ID = ""
+	}()
+
+	return fn()
+}
+
+// ForceUnLockState releases the lock on the state on behalf of whoever is holding it.
+// The lock ID must match the one in the current lock metadata, so that a lock that has been re-acquired since is never released by mistake.
+func ForceUnLockState(metadata *types.RequestMetadata, storageClient types.StorageClient, lockID string) error {
+	if lockID == "" {
+		return errors.New("Lock ID is required to force-unlock the state")
+	}
+
+	metadata.ID = lockID
+	if err := lockedByMe(metadata, storageClient); err != nil {
+		return err
+	}
+
+	return releaseLock(metadata, storageClient)
+}
+
+// getStateLockLister checks if storage client can enumerate the locks.
+func getStateLockLister(storageClient types.StorageClient) (types.StateLockLister, error) {
+	lockLister, ok := storageClient.(types.StateLockLister)
+	if !ok {
+		return nil, types.ErrNotSupported
+	}
+
+	return lockLister, nil
+}
+
+// ListLocks reads all locks held in the storage, sorted by the state path.
+// Returns ErrNotSupported if storage type can't enumerate the locks.
+func ListLocks(metadata *types.RequestMetadata, storageClient types.StorageClient) ([]types.StateLock, error) {
+	lockLister, err := getStateLockLister(storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := lockLister.ListStateLocks(metadata.Params)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	locks := make([]types.StateLock, 0, len(raw))
+	for state, lock := range raw {
+		stateLock := types.StateLock{State: state}
+		if err := json.Unmarshal(lock, &stateLock.LockInfo); err != nil {
+			log.Printf("Failed to read lock on %s: %s", state, err)
+			continue
+		}
+		if !stateLock.Created.IsZero() {
+			stateLock.Age = now.Sub(stateLock.Created)
+		}
+		locks = append(locks, stateLock)
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].State < locks[j].State
+	})
+
+	return locks, nil
+}
+
+// lockTTL is how long a lock can be held before it is considered stale, zero means it never is.
+func lockTTL() time.Duration {
+	return viper.GetDuration("lockTTL")
+}
+
+// isStale checks if the lock has been held for longer than ttl.
+// Locks without creation time are never stale, as there is no telling how old they are.
+func isStale(lockInfo *types.LockInfo, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && !lockInfo.Created.IsZero() && now.Sub(lockInfo.Created) > ttl
+}
+
+// releaseStaleLock force-releases the lock that has been found stale, leaving a record of it in the log.
+func releaseStaleLock(metadata *types.RequestMetadata, storageClient types.StorageClient, lockInfo *types.LockInfo) error {
+	log.Printf("Releasing stale lock %s on %s held by %s since %s for %s (Terraform %s)",
+		lockInfo.ID, metadata.Params.String(), lockInfo.Who, lockInfo.Created.Format(time.RFC3339), lockInfo.Operation, lockInfo.Version)
+
+	forceMetadata := *metadata
+	return ForceUnLockState(&forceMetadata, storageClient, lockInfo.ID)
+}
+
+// ReapLocks force-releases all locks in the storage that have been held for longer than the lock TTL.
+// Returns the locks that were released.
+func ReapLocks(metadata *types.RequestMetadata, storageClient types.StorageClient) ([]types.StateLock, error) {
+	ttl := lockTTL()
+	if ttl <= 0 {
+		return nil, errors.New("Lock TTL is not set, there are no stale locks")
+	}
+
+	lockLister, err := getStateLockLister(storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	locks, err := ListLocks(metadata, storageClient)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	reaped := make([]types.StateLock, 0)
+	for _, lock := range locks {
+		if !isStale(&lock.LockInfo, ttl, now) {
+			continue
+		}
+
+		stateMetadata := &types.RequestMetadata{
+			Type:   metadata.Type,
+			Params: lockLister.ParamsForState(metadata.Params, lock.State),
+		}
+		if err := releaseStaleLock(stateMetadata, storageClient, &lock.LockInfo); err != nil {
+			// Someone else might have released or re-acquired it in the meantime, carry on with the rest
+			log.Printf("Failed to release stale lock %s on %s: %s", lock.ID, lock.State, err)
+			continue
+		}
+
+		reaped = append(reaped, lock)
+	}
+
+	return reaped, nil
+}
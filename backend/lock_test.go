@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// setLockTTL configures lockTTL for the duration of the test
+func setLockTTL(t *testing.T, ttl time.Duration) {
+	t.Helper()
+
+	viper.Set("lockTTL", ttl)
+	t.Cleanup(func() { viper.Set("lockTTL", 0) })
+}
+
+func TestForceUnLockState(t *testing.T) {
+	storage := newTestStorage()
+	params := &testParams{state: "state.json"}
+
+	if err := ForceUnLockState(newTestMetadata("state.json"), storage, "1"); err != types.ErrLockMissing {
+		t.Fatalf("expected ErrLockMissing, got %v", err)
+	}
+
+	if err := storage.LockState(params, lockBody(t, "1", time.Now())); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := ForceUnLockState(newTestMetadata("state.json"), storage, ""); err == nil {
+		t.Fatal("expected error without lock ID")
+	}
+
+	// Lock that has been re-acquired by someone else since must never be released by mistake
+	err := ForceUnLockState(newTestMetadata("state.json"), storage, "2")
+	if errLocked, ok := err.(*types.ErrLocked); !ok || errLocked.LockInfo.ID != "1" {
+		t.Fatalf("expected ErrLocked by 1, got %v", err)
+	}
+	if _, err := storage.ReadStateLock(params); err != nil {
+		t.Fatalf("expected lock to stay in place, got %v", err)
+	}
+
+	if err := ForceUnLockState(newTestMetadata("state.json"), storage, "1"); err != nil {
+		t.Fatalf("force unlock: %v", err)
+	}
+	if _, err := storage.ReadStateLock(params); err != types.ErrLockMissing {
+		t.Fatalf("expected ErrLockMissing, got %v", err)
+	}
+}
+
+func TestIsStale(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		created time.Time
+		ttl     time.Duration
+		stale   bool
+	}{
+		{name: "older than ttl", created: now.Add(-2 * time.Hour), ttl: time.Hour, stale: true},
+		{name: "younger than ttl", created: now.Add(-30 * time.Minute), ttl: time.Hour},
+		{name: "exactly ttl", created: now.Add(-time.Hour), ttl: time.Hour},
+		{name: "just over ttl", created: now.Add(-time.Hour - time.Nanosecond), ttl: time.Hour, stale: true},
+		{name: "zero ttl", created: now.Add(-24 * time.Hour), ttl: 0},
+		{name: "negative ttl", created: now.Add(-24 * time.Hour), ttl: -time.Hour},
+		{name: "zero created", ttl: time.Hour},
+		{name: "created in the future", created: now.Add(time.Hour), ttl: time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if stale := isStale(&types.LockInfo{Created: test.created}, test.ttl, now); stale != test.stale {
+				t.Fatalf("expected stale=%t, got %t", test.stale, stale)
+			}
+		})
+	}
+}
+
+func TestLockState_ReleasesStaleLock(t *testing.T) {
+	storage := newTestStorage()
+	params := &testParams{state: "state.json"}
+
+	if err := storage.LockState(params, lockBody(t, "old", time.Now().Add(-2*time.Hour))); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	// Without lock TTL, no lock is ever stale
+	err := LockState(newTestMetadata("state.json"), storage, lockBody(t, "new", time.Now()))
+	if errLocked, ok := err.(*types.ErrLocked); !ok || errLocked.LockInfo.ID != "old" {
+		t.Fatalf("expected ErrLocked by old, got %v", err)
+	}
+
+	setLockTTL(t, 3*time.Hour)
+	err = LockState(newTestMetadata("state.json"), storage, lockBody(t, "new", time.Now()))
+	if errLocked, ok := err.(*types.ErrLocked); !ok || errLocked.LockInfo.ID != "old" {
+		t.Fatalf("expected ErrLocked by old, got %v", err)
+	}
+
+	setLockTTL(t, time.Hour)
+	if err := LockState(newTestMetadata("state.json"), storage, lockBody(t, "new", time.Now())); err != nil {
+		t.Fatalf("expected stale lock to be released and re-acquired, got %v", err)
+	}
+
+	metadata := newTestMetadata("state.json")
+	metadata.ID = "new"
+	if err := lockedByMe(metadata, storage); err != nil {
+		t.Fatalf("expected state to be locked by new, got %v", err)
+	}
+}
+
+func TestReapLocks(t *testing.T) {
+	storage := newTestStorage()
+	metadata := newTestMetadata(".")
+
+	if _, err := ReapLocks(metadata, storage); err == nil {
+		t.Fatal("expected error without lock TTL")
+	}
+
+	for state, created := range map[string]time.Time{
+		"stale.json":   time.Now().Add(-2 * time.Hour),
+		"fresh.json":   time.Now(),
+		"unknown.json": {},
+	} {
+		if err := storage.LockState(&testParams{state: state}, lockBody(t, state, created)); err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+	}
+
+	setLockTTL(t, time.Hour)
+	reaped, err := ReapLocks(metadata, storage)
+	if err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if len(reaped) != 1 || reaped[0].State != "stale.json" || reaped[0].ID != "stale.json" {
+		t.Fatalf("expected only stale.json to be reaped, got %+v", reaped)
+	}
+	if len(storage.locks) != 2 || storage.locks["stale.json"] != nil {
+		t.Fatalf("expected fresh and unknown locks to stay, got %q", storage.locks)
+	}
+
+	// Released stale lock can be acquired again
+	if err := LockState(newTestMetadata("stale.json"), storage, lockBody(t, "new", time.Now())); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+}
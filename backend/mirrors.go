@@ -0,0 +1,16 @@
+package backend
+
+import (
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// SyncMirrors brings all mirrors of the storage up to date, and returns the ones synced.
+// Returns ErrNotSupported if storage type does not support mirrors.
+func SyncMirrors(metadata *types.RequestMetadata, storageClient types.StorageClient) ([]string, error) {
+	mirrorSyncer, ok := storageClient.(types.StateMirrorSyncer)
+	if !ok {
+		return nil, types.ErrNotSupported
+	}
+
+	return mirrorSyncer.SyncMirrors(metadata.Params)
+}
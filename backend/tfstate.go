@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// bumpSerial makes sure the serial of the state is greater than the serial of the current state,
+// so Terraform treats the state as a newer one.
+// States that are not valid Terraform states are returned as-is.
+func bumpSerial(state, current []byte) []byte {
+	var currentState struct {
+		Serial *uint64 `json:"serial"`
+	}
+	if err := json.Unmarshal(current, &currentState); err != nil || currentState.Serial == nil {
+		return state
+	}
+
+	var s map[string]json.RawMessage
+	if err := json.Unmarshal(state, &s); err != nil {
+		return state
+	}
+	if _, ok := s["serial"]; !ok {
+		return state
+	}
+
+	serial, err := json.Marshal(*currentState.Serial + 1)
+	if err != nil {
+		return state
+	}
+	s["serial"] = serial
+
+	bumped, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return state
+	}
+
+	return append(bumped, '\n')
+}
+
+// tfState is a subset of Terraform state (version 4) needed to compare states.
+// See https://github.com/hashicorp/terraform/blob/v1.1.3/internal/states/statefile/version4.go.
+type tfState struct {
+	Serial    uint64                   `json:"serial"`
+	Lineage   string                   `json:"lineage"`
+	Outputs   map[string]tfStateOutput `json:"outputs"`
+	Resources []tfStateResource        `json:"resources"`
+}
+
+type tfStateOutput struct {
+	Value json.RawMessage `json:"value"`
+	Type  json.RawMessage `json:"type"`
+}
+
+type tfStateResource struct {
+	Module    string                    `json:"module"`
+	Mode      string                    `json:"mode"`
+	Type      string                    `json:"type"`
+	Name      string                    `json:"name"`
+	Instances []tfStateResourceInstance `json:"instances"`
+}
+
+type tfStateResourceInstance struct {
+	IndexKey   json.RawMessage            `json:"index_key"`
+	Deposed    string                     `json:"deposed"`
+	Attributes map[string]json.RawMessage `json:"attributes"`
+}
+
+// parseTFState parses Terraform state, empty state is a valid state with nothing in it.
+func parseTFState(state []byte) (*tfState, error) {
+	s := &tfState{}
+	if len(state) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(state, s); err != nil {
+		return nil, fmt.Errorf("Not a Terraform state: %w", err)
+	}
+
+	return s, nil
+}
+
+// instances maps every resource instance address in the state to it's attributes
+func (s *tfState) instances() map[string]map[string]json.RawMessage {
+	instances := make(map[string]map[string]json.RawMessage)
+
+	for _, resource := range s.Resources {
+		address := resource.Type + "." + resource.Name
+		if resource.Mode == "data" {
+			address = "data." + address
+		}
+		if resource.Module != "" {
+			address = resource.Module + "." + address
+		}
+
+		for _, instance := range resource.Instances {
+			instanceAddress := address
+			if len(instance.IndexKey) > 0 {
+				instanceAddress += "[" + string(instance.IndexKey) + "]"
+			}
+			if instance.Deposed != "" {
+				instanceAddress += " (deposed " + instance.Deposed + ")"
+			}
+
+			instances[instanceAddress] = instance.Attributes
+		}
+	}
+
+	return instances
+}
+
+// jsonEqual compares two JSON documents semantically, ignoring formatting and keys order
+func jsonEqual(a, b json.RawMessage) bool {
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		return bytes.Equal(a, b)
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return reflect.DeepEqual(av, bv)
+}
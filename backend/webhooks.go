@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+const (
+	// defaultWebhookTimeout is how long to wait for a webhook to respond unless webhookTimeout says otherwise
+	defaultWebhookTimeout = 10 * time.Second
+
+	// webhookEventHeader tells the webhook which event it is without parsing the payload
+	webhookEventHeader = "X-Terraform-Backend-Git-Event"
+
+	// webhookSignatureHeader carries HMAC-SHA256 of the payload with webhookSecret, if it was set
+	webhookSignatureHeader = "X-Terraform-Backend-Git-Signature"
+)
+
+func init() {
+	viper.SetDefault("webhookTimeout", defaultWebhookTimeout)
+}
+
+// notifications tracks events being sent in the background
+var notifications sync.WaitGroup
+
+// notify sends the event to all webhooks subscribed to it.
+// It is done in the background, so that slow webhooks don't slow down Terraform - failures are only logged.
+func notify(name string, metadata *types.RequestMetadata, conflicting *types.LockInfo) {
+	webhooks := viper.GetStringSlice("webhooks")
+	if len(webhooks) == 0 || !subscribed(name) {
+		return
+	}
+
+	event := types.Event{
+		Event:               name,
+		Time:                time.Now().UTC(),
+		Type:                metadata.Type,
+		LockInfo:            metadata.LockInfo,
+		ConflictingLockInfo: conflicting,
+	}
+	if describer, ok := metadata.Params.(types.EventDescriber); ok {
+		describer.DescribeEvent(&event)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %s", name, err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		notifications.Add(1)
+		go func(webhook string) {
+			defer notifications.Done()
+			if err := postWebhook(webhook, name, payload); err != nil {
+				log.Printf("Failed to send %s event to webhook %s: %s", name, redactURL(webhook), err)
+			}
+		}(webhook)
+	}
+}
+
+// reportedConflicts remembers the ID of the conflicting lock last reported for each state.
+// Terraform keeps retrying the lock with -lock-timeout, and webhooks don't need to hear about the same conflict every time.
+var reportedConflicts = struct {
+	sync.Mutex
+	ids map[string]string
+}{ids: make(map[string]string)}
+
+// conflictKey identifies the state in reportedConflicts
+func conflictKey(metadata *types.RequestMetadata) string {
+	return metadata.Type + ":" + metadata.Params.String()
+}
+
+// notifyConflict sends lock_conflict event, unless the same conflicting lock has already been reported for this state.
+func notifyConflict(metadata *types.RequestMetadata, conflicting *types.LockInfo) {
+	if len(viper.GetStringSlice("webhooks")) == 0 {
+		return
+	}
+
+	id := ""
+	if conflicting != nil {
+		id = conflicting.ID
+	}
+
+	reportedConflicts.Lock()
+	last, reported := reportedConflicts.ids[conflictKey(metadata)]
+	reportedConflicts.ids[conflictKey(metadata)] = id
+	reportedConflicts.Unlock()
+
+	if reported && last == id {
+		return
+	}
+
+	notify(types.EventLockConflict, metadata, conflicting)
+}
+
+// forgetConflict is called once the state was locked, so the next conflict on it is reported again
+func forgetConflict(metadata *types.RequestMetadata) {
+	reportedConflicts.Lock()
+	delete(reportedConflicts.ids, conflictKey(metadata))
+	reportedConflicts.Unlock()
+}
+
+// subscribed checks if the event is in webhookEvents, all events are sent if it was not set
+func subscribed(name string) bool {
+	events := viper.GetStringSlice("webhookEvents")
+	if len(events) == 0 {
+		return true
+	}
+
+	for _, event := range events {
+		if event == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// postWebhook sends the payload to the webhook, signing it with webhookSecret if it was set
+func postWebhook(webhook, name string, payload []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(webhookEventHeader, name)
+
+	if secret := viper.GetString("webhookSecret"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		request.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: viper.GetDuration("webhookTimeout")}
+	response, err := client.Do(request)
+	if err != nil {
+		// Error includes the URL, which might have a secret in it
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+
+	return nil
+}
+
+// redactURL leaves only the scheme and the host of the webhook URL for logs, chat webhooks often have the secret in the path
+func redactURL(webhook string) string {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return "<invalid URL>"
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// WaitForNotifications blocks until all events sent so far were either delivered or failed.
+// Short-lived processes must call it before exiting, so the events are not lost.
+func WaitForNotifications() {
+	notifications.Wait()
+}
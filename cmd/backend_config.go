@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// backendConfigParams discovers parameters common for all backend wrappers,
+// that are required to render TF HTTP backend config pointing to this backend
+func backendConfigParams() map[string]string {
+	_, okHttpCert := os.LookupEnv("TF_BACKEND_GIT_HTTPS_CERT")
+	_, okHttpKey := os.LookupEnv("TF_BACKEND_GIT_HTTPS_KEY")
+	protocol := "http"
+	if okHttpCert && okHttpKey {
+		protocol = "https"
+	}
+
+	skipHttpsVerification, okSkipHttpsVerification := os.LookupEnv("TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION")
+	if !okSkipHttpsVerification {
+		skipHttpsVerification = "false"
+	}
+
+	username, _ := os.LookupEnv("TF_BACKEND_GIT_HTTP_USERNAME")
+	password, _ := os.LookupEnv("TF_BACKEND_GIT_HTTP_PASSWORD")
+
+	addr := strings.Split(viper.GetString("address"), ":")
+	return map[string]string{
+		"port":                  addr[len(addr)-1],
+		"protocol":              protocol,
+		"skipHttpsVerification": skipHttpsVerification,
+		"username":              username,
+		"password":              password,
+	}
+}
+
+// backendHTTPClient makes a client for CLI commands calling the running backend.
+// It trusts the backend certificate the same way Terraform is configured to in the wrapper mode.
+func backendHTTPClient() (*http.Client, error) {
+	skipHttpsVerification, okSkipHttpsVerification := os.LookupEnv("TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION")
+	if !okSkipHttpsVerification {
+		return http.DefaultClient, nil
+	}
+
+	skip, err := strconv.ParseBool(skipHttpsVerification)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: skip}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// writeBackendConfig renders TF HTTP backend config template to a file
+func writeBackendConfig(path string, t *template.Template, p map[string]string) {
+	backendConfig, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer backendConfig.Close()
+
+	if err := t.Execute(backendConfig, p); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// diffCmd will compare two versions of the state
+var diffCmd = &cobra.Command{
+	Use:           "diff FROM [TO]",
+	Short:         "Compare resources and outputs between two versions of the state",
+	Long:          "Works with the storage directly, it does not need a running backend. If TO revision was not specified, FROM is compared with the current state.",
+	Args:          cobra.RangeArgs(1, 2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		from, to := args[0], ""
+		if len(args) > 1 {
+			to = args[1]
+		}
+
+		return withStorage(cmd, nil, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			diff, err := backend.DiffState(metadata, storageClient, from, to)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				return json.NewEncoder(os.Stdout).Encode(diff)
+			}
+
+			printDiff(diff)
+			return nil
+		})
+	},
+}
+
+// printDiff prints the diff in human readable form
+func printDiff(diff *types.StateDiff) {
+	if diff.FromSerial != diff.ToSerial {
+		fmt.Printf("Serial: %d -> %d\n", diff.FromSerial, diff.ToSerial)
+	}
+	if diff.FromLineage != diff.ToLineage {
+		fmt.Printf("Lineage: %q -> %q\n", diff.FromLineage, diff.ToLineage)
+	}
+
+	if len(diff.ResourcesAdded)+len(diff.ResourcesRemoved)+len(diff.ResourcesChanged) > 0 {
+		fmt.Println("Resources:")
+		for _, address := range diff.ResourcesAdded {
+			fmt.Printf("  + %s\n", address)
+		}
+		for _, address := range diff.ResourcesRemoved {
+			fmt.Printf("  - %s\n", address)
+		}
+		for _, change := range diff.ResourcesChanged {
+			fmt.Printf("  ~ %s (%s)\n", change.Address, strings.Join(change.Attributes, ", "))
+		}
+	}
+
+	if len(diff.OutputsAdded)+len(diff.OutputsRemoved)+len(diff.OutputsChanged) > 0 {
+		fmt.Println("Outputs:")
+		for _, name := range diff.OutputsAdded {
+			fmt.Printf("  + %s\n", name)
+		}
+		for _, name := range diff.OutputsRemoved {
+			fmt.Printf("  - %s\n", name)
+		}
+		for _, name := range diff.OutputsChanged {
+			fmt.Printf("  ~ %s\n", name)
+		}
+	}
+}
+
+func init() {
+	addStorageFlags(diffCmd)
+	diffCmd.Flags().Bool("json", false, "Print the diff as JSON")
+
+	rootCmd.AddCommand(diffCmd)
+}
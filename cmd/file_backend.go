@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"text/template"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/cmd/discovery"
+	"github.com/plumber-cd/terraform-backend-git/server"
+
+	_ "github.com/plumber-cd/terraform-backend-git/storages/file" // force it to init
+)
+
+// fileHTTPBackendConfigPath is a path to the backend tf config to generate
+const fileHTTPBackendConfigPath = "file_http_backend.auto.tf"
+
+// fileBackendCmd will generate backend config and then start the wrapper
+var fileBackendCmd = &cobra.Command{
+	Use:   "file",
+	Short: "Start backend in local File storage mode and execute the wrapper",
+	Long:  "It will also generate " + fileHTTPBackendConfigPath + " in current working directory pointing to this backend",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cd := viper.GetString("file.dir")
+		if cd != "" {
+			if err := os.Chdir(cd); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		t, err := template.New(fileHTTPBackendConfigPath).Parse(`
+terraform {
+	backend "http" {
+		address = "{{ .protocol }}://localhost:{{ .port }}/?type=file&directory={{ urlquery .directory }}&state={{ urlquery .state }}"
+		lock_address = "{{ .protocol }}://localhost:{{ .port }}/?type=file&directory={{ urlquery .directory }}&state={{ urlquery .state }}"
+		unlock_address = "{{ .protocol }}://localhost:{{ .port }}/?type=file&directory={{ urlquery .directory }}&state={{ urlquery .state }}"
+		skip_cert_verification = {{ .skipHttpsVerification }}
+		username = "{{ .username }}"
+		password = "{{ .password }}"
+	}
+}
+		`)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		p := backendConfigParams()
+
+		for _, flag := range []string{"directory", "state"} {
+			if p[flag] = viper.GetString("file." + flag); p[flag] == "" {
+				log.Fatalf("%s must be set", flag)
+			}
+		}
+
+		// Backend config must not depend on the working directory Terraform was started from
+		if p["directory"], err = defaultFileRoot(p["directory"]); err != nil {
+			log.Fatal(err)
+		}
+
+		writeBackendConfig(fileHTTPBackendConfigPath, t, p)
+
+		go server.Start()
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if err := os.Remove(fileHTTPBackendConfigPath); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	fileBackendCmd.PersistentFlags().String("directory", "", "Local directory to use as storage")
+	viper.BindPFlag("file.directory", fileBackendCmd.PersistentFlags().Lookup("directory"))
+
+	fileBackendCmd.PersistentFlags().StringP("state", "s", "", "Path to the state file in that directory")
+	viper.BindPFlag("file.state", fileBackendCmd.PersistentFlags().Lookup("state"))
+
+	fileBackendCmd.PersistentFlags().StringP("dir", "d", "", "Change current working directory")
+	viper.BindPFlag("file.dir", fileBackendCmd.PersistentFlags().Lookup("dir"))
+
+	discovery.RegisterBackend(fileBackendCmd)
+}
@@ -3,7 +3,6 @@ package cmd
 import (
 	"log"
 	"os"
-	"strings"
 	"text/template"
 
 	"github.com/spf13/cobra"
@@ -47,29 +46,7 @@ terraform {
 			log.Fatal(err)
 		}
 
-		_, okHttpCert := os.LookupEnv("TF_BACKEND_GIT_HTTPS_CERT")
-		_, okHttpKey := os.LookupEnv("TF_BACKEND_GIT_HTTPS_KEY")
-		protocol := "http"
-		if okHttpCert && okHttpKey {
-			protocol = "https"
-		}
-
-		skipHttpsVerification, okSkipHttpsVerification := os.LookupEnv("TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION")
-		if !okSkipHttpsVerification {
-			skipHttpsVerification = "false"
-		}
-
-		username, _ := os.LookupEnv("TF_BACKEND_GIT_HTTP_USERNAME")
-		password, _ := os.LookupEnv("TF_BACKEND_GIT_HTTP_PASSWORD")
-
-		addr := strings.Split(viper.GetString("address"), ":")
-		p := map[string]string{
-			"port":                  addr[len(addr)-1],
-			"protocol":              protocol,
-			"skipHttpsVerification": skipHttpsVerification,
-			"username":              username,
-			"password":              password,
-		}
+		p := backendConfigParams()
 
 		for _, flag := range []string{"repository", "ref", "state"} {
 			if p[flag] = viper.GetString("git." + flag); p[flag] == "" {
@@ -78,15 +55,7 @@ terraform {
 		}
 		p["amend"] = viper.GetString("git.amend")
 
-		backendConfig, err := os.OpenFile(gitHTTPBackendConfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer backendConfig.Close()
-
-		if err := t.Execute(backendConfig, p); err != nil {
-			log.Fatal(err)
-		}
+		writeBackendConfig(gitHTTPBackendConfigPath, t, p)
 
 		go server.Start()
 	},
@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/spf13/viper"
+)
+
+// hclDecoder reads terraform-backend-git.hcl, viper does not support HCL out of the box anymore
+type hclDecoder struct{}
+
+// Decode implements viper.Decoder
+func (hclDecoder) Decode(b []byte, v map[string]interface{}) error {
+	return hcl.Unmarshal(b, &v)
+}
+
+// configDecoders adds HCL to the formats viper supports
+type configDecoders struct {
+	viper.DecoderRegistry
+}
+
+// Decoder implements viper.DecoderRegistry
+func (decoders configDecoders) Decoder(format string) (viper.Decoder, error) {
+	if strings.EqualFold(format, "hcl") {
+		return hclDecoder{}, nil
+	}
+
+	return decoders.DecoderRegistry.Decoder(format)
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig loads the HCL config the same way the backend does on start
+func loadTestConfig(t *testing.T, config string) {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "terraform-backend-git.hcl")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	previous := cfgFile
+	cfgFile = file
+	t.Cleanup(func() { cfgFile = previous })
+
+	initConfig()
+}
+
+func TestInitConfig_HCL(t *testing.T) {
+	loadTestConfig(t, `
+address = "127.0.0.1:6062"
+git.repository = "git@github.com:my-org/tf-state.git"
+git.ref = "main"
+`)
+
+	for key, expected := range map[string]string{
+		"address":        "127.0.0.1:6062",
+		"git.repository": "git@github.com:my-org/tf-state.git",
+		"git.ref":        "main",
+	} {
+		if actual := viper.GetString(key); actual != expected {
+			t.Fatalf("expected %s = %q, got %q", key, expected, actual)
+		}
+	}
+}
+
+func TestInitConfig_HCLCredentials(t *testing.T) {
+	loadTestConfig(t, `
+git.credentials = [
+  {
+    repository   = "https://github.com/my-org/*"
+    username     = "x-access-token"
+    passwordFile = "/run/secrets/my-org-token"
+  },
+  {
+    repository       = "https://gitlab.my-org.com/*"
+    credentialHelper = "manager"
+  },
+  {
+    repository       = "git@github.com:other-org/*"
+    sshKey           = ["~/.ssh/other_org_ed25519"]
+    sshKeyPassphrase = "..."
+  },
+  {
+    repository = "ssh://git@git.my-org.com/*"
+    sshAgent   = true
+  },
+]
+`)
+
+	// Same keys the git storage reads the entries with
+	type entry struct {
+		Repository       string   `mapstructure:"repository"`
+		Username         string   `mapstructure:"username"`
+		PasswordFile     string   `mapstructure:"passwordFile"`
+		CredentialHelper string   `mapstructure:"credentialHelper"`
+		SSHAgent         bool     `mapstructure:"sshAgent"`
+		SSHKey           []string `mapstructure:"sshKey"`
+		SSHKeyPassphrase string   `mapstructure:"sshKeyPassphrase"`
+	}
+
+	var entries []entry
+	if err := viper.UnmarshalKey("git.credentials", &entries); err != nil {
+		t.Fatalf("unmarshal git.credentials: %v", err)
+	}
+
+	expected := []entry{
+		{Repository: "https://github.com/my-org/*", Username: "x-access-token", PasswordFile: "/run/secrets/my-org-token"},
+		{Repository: "https://gitlab.my-org.com/*", CredentialHelper: "manager"},
+		{Repository: "git@github.com:other-org/*", SSHKey: []string{"~/.ssh/other_org_ed25519"}, SSHKeyPassphrase: "..."},
+		{Repository: "ssh://git@git.my-org.com/*", SSHAgent: true},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, entries)
+	}
+}
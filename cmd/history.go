@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// historyCmd will list versions of the state
+var historyCmd = &cobra.Command{
+	Use:           "history",
+	Short:         "List versions of the state",
+	Long:          "Works with the storage directly, it does not need a running backend",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		return withStorage(cmd, nil, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			versions, err := backend.GetStateHistory(metadata, storageClient)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				return json.NewEncoder(os.Stdout).Encode(versions)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "REVISION\tTIME\tAUTHOR\tMESSAGE")
+			for _, version := range versions {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", version.Revision, version.Time.Format(time.RFC3339), version.Author, firstLine(version.Message))
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// historyShowCmd will print the state as it was at the given revision
+var historyShowCmd = &cobra.Command{
+	Use:           "show REVISION",
+	Short:         "Print the state as it was at the revision",
+	Long:          "Works with the storage directly, it does not need a running backend. State will be decrypted if encryption is enabled.",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withStorage(cmd, nil, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			state, err := backend.GetStateVersion(metadata, storageClient, args[0])
+			if err != nil {
+				return err
+			}
+
+			_, err = os.Stdout.Write(state)
+			return err
+		})
+	},
+}
+
+// historyCompactCmd will drop old versions of the states from the history
+var historyCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Drop old versions of the states from the history",
+	Long: `Works with the storage directly, it does not need a running backend. Only the states given by --state or --states are compacted,
+a path ending with a slash selects all states in that directory. Other files in the storage always keep all of their history.
+A version is kept if it is one of --keep most recent versions of the state, or if it was made within --since. The latest version of every state is always kept.
+States that would lose versions are locked while the history is rewritten.`,
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keep, err := cmd.Flags().GetInt("keep")
+		if err != nil {
+			return err
+		}
+
+		since, err := cmd.Flags().GetDuration("since")
+		if err != nil {
+			return err
+		}
+
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+
+		states, err := cmd.Flags().GetStringSlice("states")
+		if err != nil {
+			return err
+		}
+
+		state, err := cmd.Flags().GetString("state")
+		if err != nil {
+			return err
+		}
+		if state != "" {
+			states = append(states, state)
+		}
+
+		policy := types.CompactionPolicy{Keep: keep, States: states}
+		if since > 0 {
+			policy.Since = time.Now().Add(-since)
+		}
+
+		extra := url.Values{}
+		extra.Set("state", ".")
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			plan, err := backend.CompactStateHistory(metadata, storageClient, policy, dryRun)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STATE\tVERSIONS\tKEPT")
+			for _, state := range plan.States {
+				fmt.Fprintf(w, "%s\t%d\t%d\n", state.State, state.Versions, state.Kept)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			if dryRun {
+				log.Printf("Dry run, history at %s was not changed", plan.Revision)
+			} else {
+				log.Printf("Compacted history of %d state(s), now at %s", len(plan.States), plan.Revision)
+			}
+			return nil
+		})
+	},
+}
+
+// firstLine returns first line of a possibly multiline message
+func firstLine(msg string) string {
+	return strings.SplitN(strings.TrimSpace(msg), "\n", 2)[0]
+}
+
+func init() {
+	addStorageFlags(historyCmd)
+	historyCmd.Flags().Bool("json", false, "Print versions as JSON")
+
+	addStorageFlags(historyShowCmd)
+
+	historyCmd.AddCommand(historyShowCmd)
+
+	addStorageFlags(historyCompactCmd)
+	historyCompactCmd.Flags().Int("keep", 0, "Keep that many most recent versions of each state")
+	historyCompactCmd.Flags().Duration("since", 0, "Keep versions made within that long, i.e. 720h")
+	historyCompactCmd.Flags().StringSlice("states", nil, "States to compact along with --state, a path ending with a slash selects all states in that directory")
+	historyCompactCmd.Flags().Bool("dry-run", false, "Only print what would be compacted")
+	historyCmd.AddCommand(historyCompactCmd)
+	rootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// locksCmd will list all locks held in the storage
+var locksCmd = &cobra.Command{
+	Use:           "locks",
+	Short:         "List all locks held in the storage",
+	Long:          "Works with the storage directly, it does not need a running backend. Locks of all states in the storage are listed, so --state is not used.",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		extra := url.Values{}
+		extra.Set("state", ".")
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			locks, err := backend.ListLocks(metadata, storageClient)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				return json.NewEncoder(os.Stdout).Encode(locks)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STATE\tID\tWHO\tOPERATION\tVERSION\tAGE")
+			for _, lock := range locks {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", lock.State, lock.ID, lock.Who, lock.Operation, lock.Version, lock.Age.Round(time.Second))
+			}
+			return w.Flush()
+		})
+	},
+}
+
+// locksReapCmd will release stale locks in the storage
+var locksReapCmd = &cobra.Command{
+	Use:           "reap",
+	Short:         "Release all locks held for longer than --lock-ttl",
+	Long:          "Works with the storage directly, it does not need a running backend. Locks of all states in the storage are looked at, so --state is not used.",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		extra := url.Values{}
+		extra.Set("state", ".")
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			locks, err := backend.ReapLocks(metadata, storageClient)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Released %d stale lock(s)", len(locks))
+			return nil
+		})
+	},
+}
+
+func init() {
+	addStorageFlags(locksCmd)
+	locksCmd.Flags().Bool("json", false, "Print locks as JSON")
+
+	addStorageFlags(locksReapCmd)
+	locksCmd.AddCommand(locksReapCmd)
+
+	rootCmd.AddCommand(locksCmd)
+}
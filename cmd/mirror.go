@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// mirrorCmd groups commands to work with mirrors of the storage
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "Work with mirrors of the storage",
+}
+
+// mirrorSyncCmd will bring the mirrors up to date
+var mirrorSyncCmd = &cobra.Command{
+	Use:           "sync",
+	Short:         "Push complete history of the ref to all mirrors",
+	Long:          "Works with the storage directly, it does not need a running backend. History of all states in the storage is pushed, so --state is not used. With git.mirrorLocks, locks are synced as well.",
+	Args:          cobra.NoArgs,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		extra := url.Values{}
+		extra.Set("state", ".")
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			mirrors, err := backend.SyncMirrors(metadata, storageClient)
+			for _, mirror := range mirrors {
+				log.Printf("Synced %s", mirror)
+			}
+			return err
+		})
+	},
+}
+
+func init() {
+	addStorageFlags(mirrorSyncCmd)
+	mirrorCmd.AddCommand(mirrorSyncCmd)
+
+	rootCmd.AddCommand(mirrorCmd)
+}
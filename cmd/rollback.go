@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// rollbackCmd will restore the state to a previous version
+var rollbackCmd = &cobra.Command{
+	Use:           "rollback REVISION",
+	Short:         "Restore the state to what it was at the revision",
+	Long:          "Works with the storage directly, it does not need a running backend. Restored state is saved as a new version of the state.",
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lockID, err := cmd.Flags().GetString("lock-id")
+		if err != nil {
+			return err
+		}
+
+		extra := url.Values{}
+		if lockID != "" {
+			extra.Set("ID", lockID)
+		}
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			if err := backend.RollbackState(metadata, storageClient, args[0]); err != nil {
+				return err
+			}
+
+			log.Printf("Rolled back %s to %s", metadata.Params.String(), args[0])
+			return nil
+		})
+	},
+}
+
+func init() {
+	addStorageFlags(rollbackCmd)
+	rollbackCmd.Flags().String("lock-id", "", "ID of the lock already held on the state, otherwise the state will be locked for the duration of the rollback")
+
+	rootCmd.AddCommand(rollbackCmd)
+}
@@ -68,11 +68,14 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("access-logs", "l", false, "Log HTTP requests to the console")
 	viper.BindPFlag("accessLogs", rootCmd.PersistentFlags().Lookup("access-logs"))
 	viper.SetDefault("accessLogs", false)
+	rootCmd.PersistentFlags().Duration("lock-ttl", 0, "Consider locks held for longer than that stale and release them, i.e. 24h (default never)")
+	viper.BindPFlag("lockTTL", rootCmd.PersistentFlags().Lookup("lock-ttl"))
 
 	discovery.RegisterRoot(rootCmd)
 }
 
 func initConfig() {
+	viper.SetOptions(viper.WithDecoderRegistry(configDecoders{viper.NewCodecRegistry()}))
 	viper.SetConfigType("hcl")
 	viper.SetConfigName("terraform-backend-git")
 
@@ -98,5 +101,9 @@ func initConfig() {
 
 	if err := viper.ReadInConfig(); err == nil {
 		log.Println("Using config file:", viper.ConfigFileUsed())
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		log.Fatalf("Failed to read config file %s: %s", viper.ConfigFileUsed(), err)
 	}
+
+	setFileRoot()
 }
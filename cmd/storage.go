@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/storages/file"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// storageFlags are the flags addressing a state in a storage, they are passed to the storage as-is as HTTP request parameters
+var storageFlags = []string{"repository", "ref", "state", "directory"}
+
+// addStorageFlags registers flags to address a state in a storage on a command that works with it directly, without a running backend
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("type", "t", "git", "Storage type")
+	cmd.Flags().StringP("repository", "r", "", "Repository to use as storage (git)")
+	cmd.Flags().StringP("ref", "b", "", "Ref (branch) to use (git)")
+	cmd.Flags().StringP("state", "s", "", "Path to the state file")
+	cmd.Flags().String("directory", "", "Local directory to use as storage (file)")
+}
+
+// storageQuery reads storage flags into HTTP request parameters the backend would expect, along with extra parameters.
+// Flags that were not set on the command line are looked up in the config under the storage type, i.e. git.repository.
+func storageQuery(cmd *cobra.Command, extra url.Values) (url.Values, error) {
+	storageType, err := cmd.Flags().GetString("type")
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("type", storageType)
+	for _, flag := range storageFlags {
+		value, err := cmd.Flags().GetString(flag)
+		if err != nil {
+			return nil, err
+		}
+		if !cmd.Flags().Changed(flag) {
+			value = viper.GetString(storageType + "." + flag)
+		}
+		if value != "" {
+			query.Set(flag, value)
+		}
+	}
+	for k, v := range extra {
+		query[k] = v
+	}
+
+	return query, nil
+}
+
+// withStorage reads storage flags, connects to the storage and calls fn.
+// Before returning, it waits for webhooks to receive events fn has caused.
+func withStorage(cmd *cobra.Command, extra url.Values, fn func(*types.RequestMetadata, types.StorageClient) error) error {
+	defer backend.WaitForNotifications()
+
+	query, err := storageQuery(cmd, extra)
+	if err != nil {
+		return err
+	}
+
+	if query.Get("type") == "file" && query.Get("directory") != "" {
+		directory, err := defaultFileRoot(query.Get("directory"))
+		if err != nil {
+			return err
+		}
+		query.Set("directory", directory)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := backend.ParseMetadata(request)
+	if err != nil {
+		return err
+	}
+
+	storageClient, err := backend.GetStorageClient(metadata)
+	if err != nil {
+		return err
+	}
+
+	if err := storageClient.ParseMetadataParams(request, metadata); err != nil {
+		return err
+	}
+
+	defer storageClient.Disconnect(metadata.Params)
+	if err := storageClient.Connect(metadata.Params); err != nil {
+		return err
+	}
+
+	return fn(metadata, storageClient)
+}
+
+// defaultFileRoot makes the directory absolute and uses it as a root for File storage, unless file.root was configured.
+// Local commands and the wrapper only serve the caller themselves, so they are confined to the directory they were given.
+func defaultFileRoot(directory string) (string, error) {
+	directory, err := filepath.Abs(directory)
+	if err != nil {
+		return "", err
+	}
+
+	if viper.GetString("file.root") == "" {
+		viper.Set("file.root", directory)
+	}
+	setFileRoot()
+
+	return directory, nil
+}
+
+// setFileRoot confines File storage type to file.root from the config
+func setFileRoot() {
+	file.SetRoot(viper.GetString("file.root"))
+}
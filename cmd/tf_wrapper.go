@@ -7,6 +7,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/plumber-cd/terraform-backend-git/backend"
 	"github.com/plumber-cd/terraform-backend-git/cmd/discovery"
 )
 
@@ -19,6 +20,9 @@ var terraformWrapperCmd = &cobra.Command{
 	SilenceUsage:          true,
 	Args:                  cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// Backend is going to stop with this process, so let it finish sending webhooks for what Terraform has done
+		defer backend.WaitForNotifications()
+
 		tf := viper.GetString("wrapper.tf.bin")
 
 		tfCommand := exec.Command(tf, args...)
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// unlockCmd will force-release the lock on the state
+var unlockCmd = &cobra.Command{
+	Use:   "unlock LOCK_ID",
+	Short: "Force-release the lock on the state",
+	Long: `Releases the lock on the state on behalf of whoever is holding it, as long as LOCK_ID matches the current lock.
+Use it instead of "terraform force-unlock", which does not work with HTTP backends.
+Works with the storage directly, unless --backend-url is given - then it asks the running backend to do it, so no access to the storage is needed.`,
+	Args:          cobra.ExactArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		backendURL, err := cmd.Flags().GetString("backend-url")
+		if err != nil {
+			return err
+		}
+
+		extra := url.Values{}
+		extra.Set("ID", args[0])
+
+		if backendURL != "" {
+			query, err := storageQuery(cmd, extra)
+			if err != nil {
+				return err
+			}
+
+			if err := remoteUnlock(backendURL, query); err != nil {
+				return err
+			}
+
+			log.Printf("Unlocked %s", args[0])
+			return nil
+		}
+
+		return withStorage(cmd, extra, func(metadata *types.RequestMetadata, storageClient types.StorageClient) error {
+			if err := backend.ForceUnLockState(metadata, storageClient, args[0]); err != nil {
+				return err
+			}
+
+			log.Printf("Unlocked %s in %s", args[0], metadata.Params.String())
+			return nil
+		})
+	},
+}
+
+// remoteUnlock calls /unlock endpoint of the running backend.
+// Uses admin credentials if they were set, or otherwise the same credentials Terraform would use.
+func remoteUnlock(backendURL string, query url.Values) error {
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(backendURL, "/")+"/unlock?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range []string{"TF_BACKEND_GIT_HTTP_ADMIN_", "TF_BACKEND_GIT_HTTP_"} {
+		username, okUsername := os.LookupEnv(prefix + "USERNAME")
+		password, okPassword := os.LookupEnv(prefix + "PASSWORD")
+		if okUsername && okPassword {
+			request.SetBasicAuth(username, password)
+			break
+		}
+	}
+
+	client, err := backendHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Backend responded with %s: %s", response.Status, string(body))
+	}
+
+	return nil
+}
+
+func init() {
+	addStorageFlags(unlockCmd)
+	unlockCmd.Flags().String("backend-url", "", "URL of the running backend to unlock the state with, i.e. http://localhost:6061")
+
+	rootCmd.AddCommand(unlockCmd)
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRemoteUnlock_SkipVerification(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost || request.URL.Path != "/unlock" || request.URL.Query().Get("ID") != "1" {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if u, p, ok := request.BasicAuth(); !ok || u != "admin" || p != "secret" {
+			response.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("TF_BACKEND_GIT_HTTP_ADMIN_USERNAME", "admin")
+	t.Setenv("TF_BACKEND_GIT_HTTP_ADMIN_PASSWORD", "secret")
+	query := url.Values{"ID": {"1"}}
+
+	// Self-signed certificate is only trusted when the verification is skipped
+	if err := remoteUnlock(server.URL, query); err == nil {
+		t.Fatal("expected certificate verification to fail")
+	}
+
+	t.Setenv("TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION", "false")
+	if err := remoteUnlock(server.URL, query); err == nil {
+		t.Fatal("expected certificate verification to fail")
+	}
+
+	t.Setenv("TF_BACKEND_GIT_HTTPS_SKIP_VERIFICATION", "true")
+	if err := remoteUnlock(server.URL+"/", query); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	if err := remoteUnlock(server.URL, url.Values{"ID": {"2"}}); err == nil {
+		t.Fatal("expected error response to be reported")
+	}
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+)
+
+// handleHistory lists versions of the state as JSON
+func handleHistory(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodGet {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Listing state history in %s", metadata.Params.String())
+
+	versions, err := backend.GetStateHistory(metadata, storageClient)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	handler.json(versions)
+}
+
+// handleHistoryState returns the state as it was at the revision requested via "revision" HTTP request parameter
+func handleHistoryState(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodGet {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	revision := request.URL.Query().Get("revision")
+	if revision == "" {
+		handler.clientError(errors.New("Missing parameter 'revision'"))
+		return
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Getting state at revision %s from %s", revision, metadata.Params.String())
+
+	state, err := backend.GetStateVersion(metadata, storageClient, revision)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(http.StatusOK)
+	_, _ = response.Write(state)
+}
+
+// handleRollback restores the state to the revision requested via "revision" HTTP request parameter.
+// If the request had a lock ID - the state must be locked with it, otherwise the state will be locked for the duration of the rollback.
+func handleRollback(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodPost {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	revision := request.URL.Query().Get("revision")
+	if revision == "" {
+		handler.clientError(errors.New("Missing parameter 'revision'"))
+		return
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Rolling back state in %s to revision %s", metadata.Params.String(), revision)
+
+	if err := backend.RollbackState(metadata, storageClient, revision); err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
+
+// handleDiff compares the state at "from" revision with the state at "to" revision (or current state if it wasn't set)
+func handleDiff(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodGet {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	from := request.URL.Query().Get("from")
+	if from == "" {
+		handler.clientError(errors.New("Missing parameter 'from'"))
+		return
+	}
+	to := request.URL.Query().Get("to")
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Comparing state in %s between revisions %s and %s", metadata.Params.String(), from, to)
+
+	diff, err := backend.DiffState(metadata, storageClient, from, to)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	handler.json(diff)
+}
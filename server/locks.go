@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+)
+
+// handleLocks lists all locks held in the storage.
+// Locks are not specific to a state, so "state" HTTP request parameter is not required.
+func handleLocks(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodGet {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("state") == "" {
+		query.Set("state", ".")
+		request.URL.RawQuery = query.Encode()
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Listing locks in %s", metadata.Params.String())
+
+	locks, err := backend.ListLocks(metadata, storageClient)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	handler.json(locks)
+}
+
+// handleReapLocks releases all stale locks held in the storage.
+// Locks are not specific to a state, so "state" HTTP request parameter is not required.
+func handleReapLocks(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodPost {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	query := request.URL.Query()
+	if query.Get("state") == "" {
+		query.Set("state", ".")
+		request.URL.RawQuery = query.Encode()
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Releasing stale locks in %s", metadata.Params.String())
+
+	locks, err := backend.ReapLocks(metadata, storageClient)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	handler.json(locks)
+}
+
+// handleUnlock force-releases the lock with the ID from "ID" HTTP request parameter.
+// Terraform HTTP backend can't do that itself, see https://github.com/hashicorp/terraform/issues/28421.
+func handleUnlock(response http.ResponseWriter, request *http.Request) {
+	handler := handler{
+		Request:  request,
+		Response: response,
+	}
+
+	if request.Method != http.MethodPost {
+		handler.clientError(errors.New("Unknown method: " + request.Method))
+		return
+	}
+
+	lockID := request.URL.Query().Get("ID")
+	if lockID == "" {
+		handler.clientError(errors.New("Missing parameter 'ID'"))
+		return
+	}
+
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
+		return
+	}
+	defer storageClient.Disconnect(metadata.Params)
+
+	log.Printf("Force-unlocking state in %s with lock %s", metadata.Params.String(), lockID)
+
+	if err := backend.ForceUnLockState(metadata, storageClient, lockID); err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	response.WriteHeader(http.StatusOK)
+}
@@ -3,6 +3,7 @@ package server
 
 import (
 	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
@@ -16,21 +17,20 @@ import (
 	"github.com/spf13/viper"
 )
 
-// Start listen for traffic
-func Start() {
-	var h http.Handler
+const (
+	// passCredentialsBasic passes through basic auth credentials Terraform sends in the Authorization header
+	passCredentialsBasic = "basic"
 
-	h = http.HandlerFunc(handleFunc)
+	// passCredentialsHeader passes through credentials from the passCredentialsHeader header
+	passCredentialsHeader = "header"
 
-	h = basicAuth(h)
-
-	if viper.GetBool("accessLogs") {
-		log.Println("WARNING: Access Logs enabled")
-		h = handlers.LoggingHandler(os.Stdout, h)
-	}
+	// defaultPassCredentialsHeader is the header to read credentials from in passCredentialsHeader mode, unless configured otherwise
+	defaultPassCredentialsHeader = "X-Git-Authorization"
+)
 
-	mux := http.NewServeMux()
-	mux.Handle("/", h)
+// Start listen for traffic
+func Start() {
+	h := newHandler()
 
 	address := viper.GetString("address")
 	log.Println("listen on", address)
@@ -38,19 +38,76 @@ func Start() {
 	httpCert, okHttpCert := os.LookupEnv("TF_BACKEND_GIT_HTTPS_CERT")
 	httpKey, okHttpKey := os.LookupEnv("TF_BACKEND_GIT_HTTPS_KEY")
 	if okHttpCert && okHttpKey {
-		log.Fatal(http.ListenAndServeTLS(address, httpCert, httpKey, mux))
+		log.Fatal(http.ListenAndServeTLS(address, httpCert, httpKey, h))
 	} else {
-		log.Fatal(http.ListenAndServe(address, mux))
+		log.Fatal(http.ListenAndServe(address, h))
 	}
 }
 
-// basicAuth checking for user authentication
-func basicAuth(next http.Handler) http.Handler {
-	backendUsername, okBackendUsername := os.LookupEnv("TF_BACKEND_GIT_HTTP_USERNAME")
-	backendPassword, okBackendPassword := os.LookupEnv("TF_BACKEND_GIT_HTTP_PASSWORD")
+// newHandler returns the handler for all endpoints, protected as configured
+func newHandler() http.Handler {
+	userAuth := basicAuth("TF_BACKEND_GIT_HTTP_USERNAME", "TF_BACKEND_GIT_HTTP_PASSWORD")
+
+	// Admin endpoints can be protected by separate credentials, otherwise they are protected the same way as Terraform endpoints
+	adminAuth := basicAuth("TF_BACKEND_GIT_HTTP_ADMIN_USERNAME", "TF_BACKEND_GIT_HTTP_ADMIN_PASSWORD")
+
+	callerCredentials := passCredentials()
+	if callerCredentials != nil && viper.GetString("passCredentials") == passCredentialsBasic && (userAuth != nil || adminAuth != nil) {
+		log.Fatal("passCredentials=basic can't be used along with TF_BACKEND_GIT_HTTP_USERNAME or TF_BACKEND_GIT_HTTP_ADMIN_USERNAME, " +
+			"as there is only one set of basic auth credentials in a request - use passCredentials=header instead")
+	}
+
+	noUserAuth := userAuth == nil
+	if noUserAuth {
+		// With credentials passed through, it is the git server who decides who can do what.
+		// Storage types that can't use these credentials refuse requests, see handler.connect.
+		if callerCredentials == nil {
+			log.Println("WARNING: HTTP basic auth is disabled, please specify TF_BACKEND_GIT_HTTP_USERNAME and TF_BACKEND_GIT_HTTP_PASSWORD")
+		}
+		userAuth = func(next http.Handler) http.Handler { return next }
+	}
+
+	if adminAuth == nil {
+		adminAuth = userAuth
+		if noUserAuth {
+			// Admin endpoints can force-release locks and overwrite states, they are never open to everyone.
+			// Credentials passed through only prove access to the storage, not the right to administer it.
+			log.Println("WARNING: Admin endpoints are disabled, please specify TF_BACKEND_GIT_HTTP_ADMIN_USERNAME and TF_BACKEND_GIT_HTTP_ADMIN_PASSWORD")
+			adminAuth = forbidden
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", userAuth(http.HandlerFunc(handleFunc)))
+	mux.Handle("/history", adminAuth(http.HandlerFunc(handleHistory)))
+	mux.Handle("/history/state", adminAuth(http.HandlerFunc(handleHistoryState)))
+	mux.Handle("/rollback", adminAuth(http.HandlerFunc(handleRollback)))
+	mux.Handle("/diff", adminAuth(http.HandlerFunc(handleDiff)))
+	mux.Handle("/locks", adminAuth(http.HandlerFunc(handleLocks)))
+	mux.Handle("/locks/reap", adminAuth(http.HandlerFunc(handleReapLocks)))
+	mux.Handle("/unlock", adminAuth(http.HandlerFunc(handleUnlock)))
+
+	var h http.Handler = mux
+
+	if callerCredentials != nil {
+		h = callerCredentials(h)
+	}
+
+	if viper.GetBool("accessLogs") {
+		log.Println("WARNING: Access Logs enabled")
+		h = handlers.LoggingHandler(os.Stdout, h)
+	}
+
+	return h
+}
+
+// basicAuth returns a middleware checking for user authentication with credentials from the environment variables.
+// Returns nil if these variables were not set.
+func basicAuth(usernameEnv, passwordEnv string) func(http.Handler) http.Handler {
+	backendUsername, okBackendUsername := os.LookupEnv(usernameEnv)
+	backendPassword, okBackendPassword := os.LookupEnv(passwordEnv)
 	if !okBackendUsername || !okBackendPassword {
-		log.Println("WARNING: HTTP basic auth is disabled, please specify TF_BACKEND_GIT_HTTP_USERNAME and TF_BACKEND_GIT_HTTP_PASSWORD")
-		return next
+		return nil
 	}
 
 	backendUsername, err := crypt.MD5(backendUsername)
@@ -63,39 +120,91 @@ func basicAuth(next http.Handler) http.Handler {
 		log.Fatal(err)
 	}
 
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			handler := handler{
+				Request:  request,
+				Response: response,
+			}
+
+			u, p, ok := request.BasicAuth()
+			if !ok {
+				handler.serverError(types.ErrUnauthorized)
+				return
+			}
+
+			u, err := crypt.MD5(u)
+			if err != nil {
+				handler.serverError(types.ErrUnauthorized)
+				return
+			}
+
+			p, err = crypt.MD5(p)
+			if err != nil {
+				handler.serverError(types.ErrUnauthorized)
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(u), []byte(backendUsername)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(backendPassword)) != 1 {
+				handler.clientError(types.ErrUnauthorized)
+				return
+			}
+
+			if next != nil {
+				next.ServeHTTP(response, request)
+			}
+		})
+	}
+}
+
+// forbidden is a middleware refusing all requests
+func forbidden(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
 		handler := handler{
 			Request:  request,
 			Response: response,
 		}
+		handler.clientError(types.ErrForbidden)
+	})
+}
 
-		u, p, ok := request.BasicAuth()
-		if !ok {
-			handler.serverError(types.ErrUnauthorized)
-			return
-		}
-
-		u, err := crypt.MD5(u)
-		if err != nil {
-			handler.serverError(types.ErrUnauthorized)
-			return
-		}
-
-		p, err = crypt.MD5(p)
-		if err != nil {
-			handler.serverError(types.ErrUnauthorized)
-			return
-		}
-
-		if subtle.ConstantTimeCompare([]byte(u), []byte(backendUsername)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(backendPassword)) != 1 {
-			handler.clientError(types.ErrUnauthorized)
-			return
+// passCredentials returns a middleware reading the caller's credentials, so the storage can use them instead of its own.
+// Returns nil if passCredentials was not set.
+func passCredentials() func(http.Handler) http.Handler {
+	header := "Authorization"
+	switch mode := viper.GetString("passCredentials"); mode {
+	case "":
+		return nil
+	case passCredentialsBasic:
+	case passCredentialsHeader:
+		header = viper.GetString("passCredentialsHeader")
+		if header == "" {
+			header = defaultPassCredentialsHeader
 		}
+	default:
+		log.Fatalf("Unknown passCredentials %q, expected %s or %s", mode, passCredentialsBasic, passCredentialsHeader)
+	}
 
-		if next != nil {
-			next.ServeHTTP(response, request)
-		}
-	})
+	log.Printf("Passing credentials from the %s header through to the storage", header)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			handler := handler{
+				Request:  request,
+				Response: response,
+			}
+
+			// The header is in the same format as Authorization, so let net/http parse it
+			authorization := &http.Request{Header: http.Header{"Authorization": {request.Header.Get(header)}}}
+			u, p, ok := authorization.BasicAuth()
+			if !ok {
+				handler.clientError(types.ErrUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(response, types.WithCredentials(request, &types.Credentials{Username: u, Password: p}))
+		})
+	}
 }
 
 // handleFunc main function responsible for routing
@@ -105,28 +214,11 @@ func handleFunc(response http.ResponseWriter, request *http.Request) {
 		Response: response,
 	}
 
-	metadata, err := backend.ParseMetadata(request)
-	if err != nil {
-		handler.clientError(err)
+	metadata, storageClient, ok := handler.connect()
+	if !ok {
 		return
 	}
-
-	storageClient, err := backend.GetStorageClient(metadata)
-	if err != nil {
-		handler.clientError(err)
-		return
-	}
-
-	if err := storageClient.ParseMetadataParams(request, metadata); err != nil {
-		handler.clientError(err)
-		return
-	}
-
 	defer storageClient.Disconnect(metadata.Params)
-	if err := storageClient.Connect(metadata.Params); err != nil {
-		handler.serverError(err)
-		return
-	}
 
 	switch request.Method {
 	case "LOCK":
@@ -214,6 +306,58 @@ type handler struct {
 	Response http.ResponseWriter
 }
 
+// connect reads metadata from the request and connects to the storage.
+// If it wasn't ok - the error response was already sent, otherwise caller must disconnect from storage when done.
+func (handler *handler) connect() (*types.RequestMetadata, types.StorageClient, bool) {
+	metadata, err := backend.ParseMetadata(handler.Request)
+	if err != nil {
+		handler.clientError(err)
+		return nil, nil, false
+	}
+
+	storageClient, err := backend.GetStorageClient(metadata)
+	if err != nil {
+		handler.clientError(err)
+		return nil, nil, false
+	}
+
+	// Passed through credentials are the only thing standing between the caller and the storage,
+	// so storage types that would not use them must not be reachable with any made up ones.
+	if types.CallerCredentials(handler.Request) != nil {
+		if _, ok := storageClient.(types.CallerCredentialsUser); !ok {
+			log.Printf("Storage type %s does not use credentials passed through", metadata.Type)
+			handler.clientError(types.ErrNotSupported)
+			return nil, nil, false
+		}
+	}
+
+	if err := storageClient.ParseMetadataParams(handler.Request, metadata); err != nil {
+		handler.clientError(err)
+		return nil, nil, false
+	}
+
+	if err := storageClient.Connect(metadata.Params); err != nil {
+		storageClient.Disconnect(metadata.Params)
+		handler.serverError(err)
+		return nil, nil, false
+	}
+
+	return metadata, storageClient, true
+}
+
+// json writes the value as JSON response
+func (handler *handler) json(v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		handler.serverError(err)
+		return
+	}
+
+	handler.Response.Header().Set("Content-Type", "application/json")
+	handler.Response.WriteHeader(http.StatusOK)
+	_, _ = handler.Response.Write(body)
+}
+
 // serverError handle the error by default assuming it was a server side error
 func (handler *handler) serverError(err error) {
 	handler.responseError(http.StatusInternalServerError, "500 - Internal Server Error", err)
@@ -239,6 +383,15 @@ func (handler *handler) responseError(defaultCode int, defaultResponse string, a
 			_, _ = handler.Response.Write([]byte("428 - Locking Required"))
 		case types.ErrStateDidNotExisted:
 			handler.Response.WriteHeader(http.StatusNoContent)
+		case types.ErrRevisionNotFound:
+			handler.Response.WriteHeader(http.StatusNotFound)
+			_, _ = handler.Response.Write([]byte("404 - Revision Not Found"))
+		case types.ErrNotSupported:
+			handler.Response.WriteHeader(http.StatusNotImplemented)
+			_, _ = handler.Response.Write([]byte("501 - Not Supported By This Storage Type"))
+		case types.ErrForbidden:
+			handler.Response.WriteHeader(http.StatusForbidden)
+			_, _ = handler.Response.Write([]byte("403 - Forbidden"))
 		case types.ErrUnauthorized:
 			handler.Response.Header().Set("WWW-Authenticate", `Basic realm=terraform-backend-git`)
 			handler.Response.WriteHeader(http.StatusUnauthorized)
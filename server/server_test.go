@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+
+	"github.com/plumber-cd/terraform-backend-git/storages/file"
+)
+
+// newFileStorage configures file storage root for the duration of the test and returns it
+func newFileStorage(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	file.SetRoot(root)
+	t.Cleanup(func() { file.SetRoot("") })
+
+	return root
+}
+
+// serve sends the request to the handler and returns the response status
+func serve(h http.HandlerFunc, method string, query url.Values) int {
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest(method, "/?"+query.Encode(), nil))
+	return response.Code
+}
+
+func TestHandleUnlock(t *testing.T) {
+	root := newFileStorage(t)
+	lockPath := filepath.Join(root, "state.json.lock")
+	if err := os.WriteFile(lockPath, []byte(`{"ID":"1","Who":"test"}`), 0600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	query := url.Values{"type": {"file"}, "directory": {"."}, "state": {"state.json"}}
+
+	if code := serve(handleUnlock, http.MethodGet, query); code != http.StatusBadRequest {
+		t.Fatalf("expected %d for GET, got %d", http.StatusBadRequest, code)
+	}
+
+	if code := serve(handleUnlock, http.MethodPost, query); code != http.StatusBadRequest {
+		t.Fatalf("expected %d without ID, got %d", http.StatusBadRequest, code)
+	}
+
+	// Lock ID must match the current lock, otherwise the lock is left alone
+	query.Set("ID", "2")
+	if code := serve(handleUnlock, http.MethodPost, query); code != http.StatusConflict {
+		t.Fatalf("expected %d for another lock ID, got %d", http.StatusConflict, code)
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("expected lock to stay in place, got %v", err)
+	}
+
+	query.Set("ID", "1")
+	if code := serve(handleUnlock, http.MethodPost, query); code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("expected lock to be released, got %v", err)
+	}
+
+	if code := serve(handleUnlock, http.MethodPost, query); code != http.StatusPreconditionRequired {
+		t.Fatalf("expected %d when not locked, got %d", http.StatusPreconditionRequired, code)
+	}
+}
+
+func TestHandleFunc_ReleasesStaleLock(t *testing.T) {
+	root := newFileStorage(t)
+	viper.Set("lockTTL", time.Hour)
+	defer viper.Set("lockTTL", 0)
+
+	stale, err := json.Marshal(&types.LockInfo{ID: "stale", Who: "test", Created: time.Now().Add(-2 * time.Hour)})
+	if err != nil {
+		t.Fatalf("marshal lock: %v", err)
+	}
+	lockPath := filepath.Join(root, "state.json.lock")
+	if err := os.WriteFile(lockPath, stale, 0600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	fresh, err := json.Marshal(&types.LockInfo{ID: "fresh", Who: "test", Created: time.Now()})
+	if err != nil {
+		t.Fatalf("marshal lock: %v", err)
+	}
+
+	query := url.Values{"type": {"file"}, "directory": {"."}, "state": {"state.json"}}
+	lock := func() int {
+		response := httptest.NewRecorder()
+		handleFunc(response, httptest.NewRequest("LOCK", "/?"+query.Encode(), strings.NewReader(string(fresh))))
+		return response.Code
+	}
+
+	if code := lock(); code != http.StatusOK {
+		t.Fatalf("expected stale lock to be released and re-acquired, got %d", code)
+	}
+
+	current, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("read lock: %v", err)
+	}
+	if string(current) != string(fresh) {
+		t.Fatalf("expected the new lock, got %s", current)
+	}
+
+	// Fresh lock is not stale, so it is a conflict now
+	if code := lock(); code != http.StatusConflict {
+		t.Fatalf("expected %d, got %d", http.StatusConflict, code)
+	}
+}
+
+func TestHandleLocks(t *testing.T) {
+	root := newFileStorage(t)
+	lock, err := json.Marshal(&types.LockInfo{ID: "1", Who: "test", Created: time.Now().Add(-90 * time.Second)})
+	if err != nil {
+		t.Fatalf("marshal lock: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "state.json.lock"), lock, 0600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	query := url.Values{"type": {"file"}, "directory": {"."}}
+	response := httptest.NewRecorder()
+	handleLocks(response, httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, response.Code)
+	}
+
+	var locks []map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &locks); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if len(locks) != 1 || locks[0]["State"] != "state.json" || locks[0]["ID"] != "1" {
+		t.Fatalf("unexpected locks %s", response.Body)
+	}
+
+	// Age is in seconds, not nanoseconds
+	if age, ok := locks[0]["AgeSeconds"].(float64); !ok || age < 90 || age > 120 {
+		t.Fatalf("expected lock age in seconds, got %s", response.Body)
+	}
+	if _, ok := locks[0]["Age"]; ok {
+		t.Fatalf("expected no age in nanoseconds, got %s", response.Body)
+	}
+}
+
+func TestPassCredentials_FileStorage(t *testing.T) {
+	root := newFileStorage(t)
+	if err := os.WriteFile(filepath.Join(root, "state.json"), []byte(`{"serial":1}`), 0600); err != nil {
+		t.Fatalf("write state: %v", err)
+	}
+
+	viper.Set("passCredentials", passCredentialsBasic)
+	defer viper.Set("passCredentials", "")
+
+	query := url.Values{"type": {"file"}, "directory": {"."}, "state": {"state.json"}}
+	for name, h := range map[string]http.HandlerFunc{"state": handleFunc, "locks": handleLocks, "history": handleHistory} {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+		request.SetBasicAuth("made", "up")
+		passCredentials()(h).ServeHTTP(response, request)
+
+		// File storage has nothing to check these credentials with
+		if response.Code != http.StatusNotImplemented || strings.Contains(response.Body.String(), "serial") {
+			t.Fatalf("%s: expected %d with made up credentials, got %d: %s", name, http.StatusNotImplemented, response.Code, response.Body)
+		}
+	}
+
+	// Same request reaches the state without credentials passed through
+	if code := serve(handleFunc, http.MethodGet, query); code != http.StatusOK {
+		t.Fatalf("expected %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestNewHandler_AdminEndpointsDisabledWithoutAuth(t *testing.T) {
+	root := newFileStorage(t)
+	lockPath := filepath.Join(root, "state.json.lock")
+	if err := os.WriteFile(lockPath, []byte(`{"ID":"1","Who":"test"}`), 0600); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	query := url.Values{"type": {"file"}, "directory": {"."}, "state": {"state.json"}, "ID": {"1"}}
+	unlock := func(h http.Handler, username, password string) int {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/unlock?"+query.Encode(), nil)
+		if username != "" {
+			request.SetBasicAuth(username, password)
+		}
+		h.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// No credentials configured at all - admin endpoints are refused to everyone
+	if code := unlock(newHandler(), "", ""); code != http.StatusForbidden {
+		t.Fatalf("expected %d without any auth configured, got %d", http.StatusForbidden, code)
+	}
+
+	// Credentials passed through to the storage don't enable them either
+	viper.Set("passCredentials", passCredentialsBasic)
+	code := unlock(newHandler(), "made", "up")
+	viper.Set("passCredentials", "")
+	if code != http.StatusForbidden {
+		t.Fatalf("expected %d with credentials passed through, got %d", http.StatusForbidden, code)
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("expected lock to stay in place, got %v", err)
+	}
+
+	// Admin endpoints fall back to the regular credentials
+	t.Setenv("TF_BACKEND_GIT_HTTP_USERNAME", "user")
+	t.Setenv("TF_BACKEND_GIT_HTTP_PASSWORD", "pswd")
+	h := newHandler()
+	if code := unlock(h, "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d without credentials, got %d", http.StatusUnauthorized, code)
+	}
+	if code := unlock(h, "user", "pswd"); code != http.StatusOK {
+		t.Fatalf("expected %d with credentials, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,235 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// NewStorageClient creates new StorageClient
+func NewStorageClient() types.StorageClient {
+	return &StorageClient{}
+}
+
+// ParseMetadataParams read request parameters specific to File storage type
+func (storageClient *StorageClient) ParseMetadataParams(request *http.Request, metadata *types.RequestMetadata) error {
+	query := request.URL.Query()
+
+	params := RequestMetadataParams{
+		Directory: query.Get("directory"),
+		State:     query.Get("state"),
+	}
+
+	if params.Directory == "" {
+		return errors.New("Missing parameter 'directory'")
+	}
+
+	if params.State == "" {
+		return errors.New("Missing parameter 'state'")
+	}
+
+	// State must stay within the directory, otherwise the request would be able to write anywhere on this host
+	params.State = path.Clean(strings.ReplaceAll(params.State, "\\", "/"))
+	if path.IsAbs(params.State) || filepath.IsAbs(params.State) || params.State == ".." || strings.HasPrefix(params.State, "../") {
+		return fmt.Errorf("State path %q must be relative to the directory", params.State)
+	}
+
+	// Lock files live next to the states, a state named like a lock would collide with the lock of another state
+	if strings.HasSuffix(params.State, ".lock") {
+		return fmt.Errorf("State path %q must not end with .lock", params.State)
+	}
+
+	directory, err := resolveDirectory(root, params.Directory)
+	if err != nil {
+		return err
+	}
+	params.Directory = directory
+
+	// Symlinks within the directory must not lead outside of the root either.
+	// State "." addresses the directory itself, i.e. to list locks in it, it has no lock of its own,
+	// so every other operation refuses it instead of touching a lock next to the directory.
+	paths := []string{statePath(&params)}
+	if params.State != "." {
+		paths = append(paths, lockPath(&params))
+	}
+	for _, path := range paths {
+		if _, err := confine(root, path); err != nil {
+			return err
+		}
+	}
+
+	metadata.Params = &params
+
+	return nil
+}
+
+// Connect makes sure the storage directory exists.
+// There are no long living connections to maintain for this storage type.
+func (storageClient *StorageClient) Connect(p types.RequestMetadataParams) error {
+	params := p.(*RequestMetadataParams)
+
+	return os.MkdirAll(params.Directory, 0700)
+}
+
+// Disconnect does nothing for File storage type.
+func (storageClient *StorageClient) Disconnect(p types.RequestMetadataParams) {}
+
+// LockState creates a ".lock" file next to the state file, containing the lock metadata.
+// File is created exclusively (O_EXCL), which makes a locking operation atomic -
+// if the file already existed, someone else already aquired the lock before this.
+func (storageClient *StorageClient) LockState(p types.RequestMetadataParams, lock []byte) error {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return err
+	}
+
+	if err := createFile(lockPath(params), lock); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return types.ErrLockingConflict
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ReadStateLock reads the lock metadata from the ".lock" file.
+// Returns ErrLockMissing if there was no such file.
+func (storageClient *StorageClient) ReadStateLock(p types.RequestMetadataParams) ([]byte, error) {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return nil, err
+	}
+
+	lock, err := os.ReadFile(lockPath(params))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, types.ErrLockMissing
+		}
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// UnLockState for File storage type, unlocking is a simple ".lock" file removal
+func (storageClient *StorageClient) UnLockState(p types.RequestMetadataParams) error {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return err
+	}
+
+	return removeFile(lockPath(params))
+}
+
+// ForceUnLockWorkaroundMessage suggest the user to delete the lock file
+func (storageClient *StorageClient) ForceUnLockWorkaroundMessage(p types.RequestMetadataParams) string {
+	params := p.(*RequestMetadataParams)
+
+	return fmt.Sprintf("As a workaround - please delete the file %s manually.\n", lockPath(params))
+}
+
+// GetState reads the state file from disk.
+// Will return ErrStateDidNotExisted if the state file did not existed.
+func (storageClient *StorageClient) GetState(p types.RequestMetadataParams) ([]byte, error) {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return nil, err
+	}
+
+	state, err := os.ReadFile(statePath(params))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, types.ErrStateDidNotExisted
+		}
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// UpdateState atomically replaces the state file on disk.
+func (storageClient *StorageClient) UpdateState(p types.RequestMetadataParams, state []byte) error {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return err
+	}
+
+	return writeFile(statePath(params), state)
+}
+
+// DeleteState removes the state file from disk.
+func (storageClient *StorageClient) DeleteState(p types.RequestMetadataParams) error {
+	params := p.(*RequestMetadataParams)
+
+	if err := requireState(params); err != nil {
+		return err
+	}
+
+	if err := os.Remove(statePath(params)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return types.ErrStateDidNotExisted
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ListStateLocks walks the storage directory and reads every ".lock" file in it.
+func (storageClient *StorageClient) ListStateLocks(p types.RequestMetadataParams) (map[string][]byte, error) {
+	params := p.(*RequestMetadataParams)
+
+	locks := make(map[string][]byte)
+	err := filepath.WalkDir(params.Directory, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !strings.HasSuffix(file, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(params.Directory, file)
+		if err != nil {
+			return err
+		}
+
+		lock, err := os.ReadFile(file)
+		if err != nil {
+			// Unlocked while we were walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		locks[strings.TrimSuffix(filepath.ToSlash(rel), ".lock")] = lock
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+// ParamsForState makes a copy of params for another state in the same directory.
+func (storageClient *StorageClient) ParamsForState(p types.RequestMetadataParams, state string) types.RequestMetadataParams {
+	params := *p.(*RequestMetadataParams)
+	params.State = state
+
+	return &params
+}
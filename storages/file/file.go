@@ -0,0 +1,191 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+)
+
+// root is the directory File storage type is confined to, see SetRoot
+var root string
+
+func init() {
+	backend.KnownStorageTypes["file"] = NewStorageClient()
+}
+
+// SetRoot confines File storage type to the root directory, requests are refused until it was set
+func SetRoot(dir string) {
+	root = dir
+}
+
+// resolveDirectory resolves the requested directory under the root directory.
+// Directory could be either relative to the root or an absolute path within it,
+// so requests are never able to read or write files outside of the root.
+// Symlinks are resolved first, so a symlink within the root can't point requests outside of it either.
+func resolveDirectory(root, directory string) (string, error) {
+	if root == "" {
+		return "", errors.New("file.root must be set to use File storage type")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(directory) {
+		directory = filepath.Join(root, directory)
+	}
+
+	return confine(root, directory)
+}
+
+// confine resolves symlinks in the path and makes sure it is within the root directory
+func confine(root, path string) (string, error) {
+	realRoot, err := evalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	realPath, err := evalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Path %q must be within the root directory %q", path, root)
+	}
+
+	return realPath, nil
+}
+
+// evalSymlinks is filepath.EvalSymlinks for paths that might not exist yet.
+// Symlinks are resolved in the part of the path that exists, the rest is appended as-is.
+// Dangling symlinks are resolved to where they point, as that's where the file would be created.
+func evalSymlinks(path string) (string, error) {
+	path = filepath.Clean(path)
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		return evalSymlinks(target)
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+
+	resolved, err = evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// statePath calculates the path to a state file on disk
+func statePath(params *RequestMetadataParams) string {
+	return filepath.Join(params.Directory, filepath.FromSlash(params.State))
+}
+
+// requireState refuses params addressing the directory itself rather than a state in it.
+// Only listing locks works on the whole directory, its lock path would be outside of it.
+func requireState(params *RequestMetadataParams) error {
+	if params.State == "." {
+		return errors.New("Directory itself is not a state, state must be set")
+	}
+
+	return nil
+}
+
+// lockPath calculates the path to a lock file on disk
+func lockPath(params *RequestMetadataParams) string {
+	return statePath(params) + ".lock"
+}
+
+// createFile atomically creates a new file with this buf as a content.
+// It will return fs.ErrExist if the file already existed.
+func createFile(path string, buf []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return nil
+}
+
+// writeFile replaces the file content with this buf.
+// Content is written to a temporary file next to the target first and then renamed over it,
+// so readers never observe a partially written file.
+func writeFile(path string, buf []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeFile deletes the file.
+// Operation is idempotent, i.e. no error will be returned if the file did not existed.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
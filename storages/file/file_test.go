@@ -0,0 +1,281 @@
+package file
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// setRoot configures the root for the duration of the test
+func setRoot(t *testing.T, root string) {
+	t.Helper()
+
+	SetRoot(root)
+	t.Cleanup(func() { SetRoot("") })
+}
+
+func parseParams(dir, state string) (*RequestMetadataParams, error) {
+	query := url.Values{}
+	query.Set("directory", dir)
+	query.Set("state", state)
+
+	metadata := &types.RequestMetadata{}
+	if err := NewStorageClient().ParseMetadataParams(httptest.NewRequest("GET", "/?"+query.Encode(), nil), metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata.Params.(*RequestMetadataParams), nil
+}
+
+func newParams(t *testing.T, dir, state string) *RequestMetadataParams {
+	t.Helper()
+
+	setRoot(t, dir)
+	params, err := parseParams(dir, state)
+	if err != nil {
+		t.Fatalf("parse params: %v", err)
+	}
+
+	return params
+}
+
+func TestParseMetadataParams_RejectsEscapingState(t *testing.T) {
+	dir := t.TempDir()
+	setRoot(t, dir)
+
+	for _, state := range []string{"../state.json", "a/../../state.json", "/etc/state.json", "state.json.lock", "env/x.lock"} {
+		if _, err := parseParams(dir, state); err == nil {
+			t.Fatalf("expected error for state %q", state)
+		}
+	}
+}
+
+func TestParseMetadataParams_Directory(t *testing.T) {
+	// Directories are returned with symlinks resolved, temp directory itself might be behind one
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("eval symlinks: %v", err)
+	}
+
+	if _, err := parseParams(root, "state.json"); err == nil {
+		t.Fatal("expected error without file.root")
+	}
+
+	setRoot(t, root)
+
+	for dir, expected := range map[string]string{
+		".":                              root,
+		"env":                            filepath.Join(root, "env"),
+		"env/../other":                   filepath.Join(root, "other"),
+		filepath.Join(root, "abs"):       filepath.Join(root, "abs"),
+		filepath.Join(root, "abs", ".."): root,
+	} {
+		params, err := parseParams(dir, "state.json")
+		if err != nil {
+			t.Fatalf("directory %q: %v", dir, err)
+		}
+		if params.Directory != expected {
+			t.Fatalf("directory %q: expected %q, got %q", dir, expected, params.Directory)
+		}
+	}
+
+	for _, dir := range []string{"..", "env/../../other", filepath.Dir(root), "/etc"} {
+		if _, err := parseParams(dir, "state.json"); err == nil {
+			t.Fatalf("expected error for directory %q", dir)
+		}
+	}
+}
+
+func TestParseMetadataParams_Symlinks(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "real"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for link, target := range map[string]string{
+		"escape":          outside,
+		"inside":          filepath.Join(root, "real"),
+		"state.json":      filepath.Join(outside, "state.json"),
+		"other.json.lock": filepath.Join(outside, "other.json.lock"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("symlink: %v", err)
+		}
+	}
+
+	// Root itself might be reached through a symlink
+	linkedRoot := filepath.Join(t.TempDir(), "linked")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	setRoot(t, linkedRoot)
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatalf("eval symlinks: %v", err)
+	}
+
+	// Symlinks within the root are fine, and directories that don't exist yet can be created later
+	for dir, expected := range map[string]string{
+		"inside":     filepath.Join(realRoot, "real"),
+		"inside/new": filepath.Join(realRoot, "real", "new"),
+		"new/env":    filepath.Join(realRoot, "new", "env"),
+	} {
+		params, err := parseParams(dir, "env.json")
+		if err != nil {
+			t.Fatalf("directory %q: %v", dir, err)
+		}
+		if params.Directory != expected {
+			t.Fatalf("directory %q: expected %q, got %q", dir, expected, params.Directory)
+		}
+	}
+
+	for _, request := range []struct{ dir, state string }{
+		{"escape", "state.json"},
+		{"escape/new", "state.json"},
+		{".", "escape/state.json"},
+		{".", "state.json"},
+		{".", "other.json"},
+	} {
+		if _, err := parseParams(request.dir, request.state); err == nil {
+			t.Fatalf("expected error for directory %q and state %q leading outside of the root", request.dir, request.state)
+		}
+	}
+}
+
+func TestLockState_Conflict(t *testing.T) {
+	client := NewStorageClient()
+	params := newParams(t, t.TempDir(), "env/state.json")
+
+	if err := client.LockState(params, []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := client.LockState(params, []byte(`{"ID":"2"}`)); err != types.ErrLockingConflict {
+		t.Fatalf("expected ErrLockingConflict, got %v", err)
+	}
+
+	lock, err := client.ReadStateLock(params)
+	if err != nil {
+		t.Fatalf("read lock: %v", err)
+	}
+	if string(lock) != `{"ID":"1"}` {
+		t.Fatalf("unexpected lock %q", lock)
+	}
+
+	if err := client.UnLockState(params); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	if _, err := client.ReadStateLock(params); err != types.ErrLockMissing {
+		t.Fatalf("expected ErrLockMissing, got %v", err)
+	}
+}
+
+func TestDirectoryState_OnlyListsLocks(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	if err := os.MkdirAll(root, 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// Lock of the directory itself would be next to it, outside of the root
+	outside := root + ".lock"
+	if err := os.WriteFile(outside, []byte("outside"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	client := NewStorageClient().(*StorageClient)
+	params := newParams(t, root, ".")
+
+	if err := client.LockState(params, []byte(`{"ID":"1"}`)); err == nil {
+		t.Fatal("expected lock error")
+	}
+	if lock, err := client.ReadStateLock(params); err == nil {
+		t.Fatalf("expected read lock error, got %q", lock)
+	}
+	if err := client.UnLockState(params); err == nil {
+		t.Fatal("expected unlock error")
+	}
+	if state, err := client.GetState(params); err == nil {
+		t.Fatalf("expected get error, got %q", state)
+	}
+	if err := client.UpdateState(params, []byte("state")); err == nil {
+		t.Fatal("expected update error")
+	}
+	if err := client.DeleteState(params); err == nil {
+		t.Fatal("expected delete error")
+	}
+
+	if content, err := os.ReadFile(outside); err != nil || string(content) != "outside" {
+		t.Fatalf("file outside of the root was touched: %q, %v", content, err)
+	}
+
+	if _, err := client.ListStateLocks(params); err != nil {
+		t.Fatalf("list locks: %v", err)
+	}
+}
+
+func TestUpdateState_GetDelete(t *testing.T) {
+	dir := t.TempDir()
+	client := NewStorageClient()
+	params := newParams(t, dir, "env/state.json")
+
+	if _, err := client.GetState(params); err != types.ErrStateDidNotExisted {
+		t.Fatalf("expected ErrStateDidNotExisted, got %v", err)
+	}
+
+	for _, content := range []string{"v1", "v2"} {
+		if err := client.UpdateState(params, []byte(content)); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+
+		state, err := client.GetState(params)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if string(state) != content {
+			t.Fatalf("expected %q, got %q", content, state)
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the state file to be left behind, got %d entries", len(entries))
+	}
+
+	if err := client.DeleteState(params); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, err := client.GetState(params); err != types.ErrStateDidNotExisted {
+		t.Fatalf("expected ErrStateDidNotExisted, got %v", err)
+	}
+}
+
+func TestListStateLocks(t *testing.T) {
+	client := NewStorageClient().(*StorageClient)
+	dir := t.TempDir()
+
+	for state, lock := range map[string]string{"env/state.json": `{"ID":"1"}`, "other.json": `{"ID":"2"}`} {
+		if err := client.LockState(newParams(t, dir, state), []byte(lock)); err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+	}
+	if err := client.UpdateState(newParams(t, dir, "other.json"), []byte("{}")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	locks, err := client.ListStateLocks(newParams(t, dir, "."))
+	if err != nil {
+		t.Fatalf("list locks: %v", err)
+	}
+	if len(locks) != 2 || string(locks["env/state.json"]) != `{"ID":"1"}` || string(locks["other.json"]) != `{"ID":"2"}` {
+		t.Fatalf("unexpected locks %q", locks)
+	}
+}
@@ -0,0 +1,27 @@
+package file
+
+import (
+	"fmt"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// RequestMetadataParams is File storage specific parameters
+type RequestMetadataParams struct {
+	Directory, State string
+}
+
+// DescribeEvent fills in the address of the state
+func (params *RequestMetadataParams) DescribeEvent(event *types.Event) {
+	event.Directory = params.Directory
+	event.State = params.State
+}
+
+// String is a human readable representation for this params set
+func (params *RequestMetadataParams) String() string {
+	return fmt.Sprintf("%s//%s", params.Directory, params.State)
+}
+
+// StorageClient implementation for File storage type.
+// It is stateless - everything it needs to know is in the RequestMetadataParams and on disk.
+type StorageClient struct{}
@@ -3,14 +3,19 @@ package git
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/viper"
+
 	"github.com/plumber-cd/terraform-backend-git/types"
 )
 
@@ -22,6 +27,9 @@ func NewStorageClient() types.StorageClient {
 	}
 }
 
+// UsesCallerCredentials marks Git storage as able to authenticate with the caller's credentials, see ParseMetadataParams and Connect
+func (storageClient *StorageClient) UsesCallerCredentials() {}
+
 // ParseMetadataParams read request parameters specific to Git storage type
 func (storageClient *StorageClient) ParseMetadataParams(request *http.Request, metadata *types.RequestMetadata) error {
 	query := request.URL.Query()
@@ -45,6 +53,13 @@ func (storageClient *StorageClient) ParseMetadataParams(request *http.Request, m
 		return errors.New("Missing parameter 'state'")
 	}
 
+	if credentials := types.CallerCredentials(request); credentials != nil {
+		params.credentials = &githttp.BasicAuth{
+			Username: credentials.Username,
+			Password: credentials.Password,
+		}
+	}
+
 	metadata.Params = &params
 
 	return nil
@@ -54,45 +69,94 @@ func (storageClient *StorageClient) ParseMetadataParams(request *http.Request, m
 // and put an exclusive lock (mutex, not TF lock) on it.
 //
 // This StorageClient implementation will use go-git and virtual in-memory FS as git local working tree.
-// Each unique RequestMetadataParams.Repository will receive it's own in-memory FS instance.
-// That FS will be shared among different requests to the same repository,
+// Each unique session key (see sessionKey) will receive it's own in-memory FS instance.
+// That FS will be shared among different requests with the same session key,
 // and it will live in memory until backend restarts.
 // This is to speed up various git actions and avoid fresh clone every time, which might be time consuming.
 //
+// If git.cacheDir was set, sessions are stored on disk instead of memory.
+// Restarted backend will then re-use existing clones and only fetch the deltas.
+//
 // Since simple TF-level actions like update state or lock/unlock in this implementation
 // involves complex add-commit-push routines that aren't really an atomic operations,
-// and the local working tree is shared by multiple requests to the same git repository,
+// and the local working tree is shared by multiple requests to the same session,
 // parallel requests can mess up the local working tree and leave it in broken state.
 //
 // Example - while one tree checked out the locking branch and preparing the lock metadata to write,
 // another request came in for totally different state and it would checkout back to Ref and pull it from remote.
 //
-// Hence we just assume that Git type of storage does not support parallel connections to the same repository,
-// and each connection will lock this repository from usage by other threads within the same backend instance.
+// Hence we just assume that a session does not support parallel connections,
+// and each connection will lock this session from usage by other threads within the same backend instance.
+//
+// By default, the session key is the repository URL - so all states in the same repository are serialized.
+// If the user values parallel connections feature over overall performance/memory requirements,
+// git.concurrency can be set to "ref" or "state" so each Ref or each state gets its own isolated session.
+// Git locking branches remain the source of truth for TF locks, so isolated sessions can't break the locking.
 //
-// This is not currently implemented,
-// but if the user values parallel connections feature over overall performance/memory requirements -
-// we can use something else for the StorageClient.sessions map key.
-// The locking/unlocking would still be required for thread-safety.
-// That could be a configurable option.
+// Sessions can be evicted when idle or when there are too many of them, see sessionsLimits.
+//
+// If the caller's credentials were passed through, each set of credentials gets its own sessions,
+// so no one can read from a clone made with someone else's credentials.
+// Sessions that failed to connect with them are evicted right away, and rejected credentials are reported as ErrUnauthorized.
 func (storageClient *StorageClient) Connect(p types.RequestMetadataParams) error {
 	params := p.(*RequestMetadataParams)
 
-	storageClient.sessionsMutex.Lock()
-	defer storageClient.sessionsMutex.Unlock()
+	key, err := sessionKey(params)
+	if err != nil {
+		return err
+	}
+
+	storageClient.janitorOnce.Do(storageClient.startJanitor)
 
-	storageSession, ok := storageClient.sessions[params.Repository]
-	if !ok {
-		s, err := newStorageSession(params)
-		if err != nil {
-			return err
+	var storageSession *storageSession
+	for {
+		// Only hold the sessions map lock while looking up the session,
+		// so that waiting for a busy session doesn't block requests to other sessions.
+		storageClient.sessionsMutex.Lock()
+		s, ok := storageClient.sessions[key]
+		if !ok {
+			s, err = newStorageSession(key, params)
+			if err != nil {
+				storageClient.sessionsMutex.Unlock()
+				return err
+			}
+
+			storageClient.sessions[key] = s
+		}
+		storageClient.sessionsMutex.Unlock()
+
+		s.mutex.Lock()
+
+		// The session might have been evicted while we were waiting for it, then just start over
+		if !s.evicted {
+			storageSession = s
+			break
 		}
 
-		storageClient.sessions[params.Repository] = s
-		storageSession = s
+		s.mutex.Unlock()
 	}
 
-	storageSession.mutex.Lock()
+	// The session is either brand new, previous attempt to connect it has failed or it's storage was dropped for a re-clone
+	if storageSession.repository == nil {
+		if err := storageSession.connect(params); err != nil {
+			if params.credentials != nil {
+				// Don't keep sessions for credentials that didn't work, anyone can make lots of them
+				storageClient.sessionsMutex.Lock()
+				storageClient.evict(storageSession)
+				storageClient.sessionsMutex.Unlock()
+			}
+			storageSession.mutex.Unlock()
+
+			if params.credentials != nil && (errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed)) {
+				log.Printf("Credentials of %s were rejected by %s: %s", params.credentials.Username, params.Repository, err)
+				return types.ErrUnauthorized
+			}
+
+			return err
+		}
+	}
+
+	params.session = storageSession
 
 	return nil
 }
@@ -103,8 +167,10 @@ func (storageClient *StorageClient) Connect(p types.RequestMetadataParams) error
 func (storageClient *StorageClient) Disconnect(p types.RequestMetadataParams) {
 	params := p.(*RequestMetadataParams)
 
-	if storageSession, ok := storageClient.sessions[params.Repository]; ok {
-		storageSession.mutex.Unlock()
+	if params.session != nil {
+		params.session.lastUsed = time.Now()
+		params.session.mutex.Unlock()
+		params.session = nil
 	}
 }
 
@@ -120,10 +186,12 @@ func (storageClient *StorageClient) Disconnect(p types.RequestMetadataParams) {
 // In other words, we are trying to keep the local working tree fast-forwardable at all times.
 //
 // And remember - git repository hosting the state is a "backend" storage and it's not meant to be used by people.
+//
+// With git.mirrorLocks, the lock branch is also pushed to mirrors, see checkMirrors and pushMirrors.
 func (storageClient *StorageClient) LockState(p types.RequestMetadataParams, lock []byte) error {
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
 
 	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
 		return err
@@ -155,19 +223,27 @@ func (storageClient *StorageClient) LockState(p types.RequestMetadataParams, loc
 		return err
 	}
 
-	if err := storageSession.commit("Lock " + params.State); err != nil {
+	if err := storageSession.commit(params, "Lock"); err != nil {
+		return err
+	}
+
+	if err := storageSession.checkLockMirrors(); err != nil {
 		return err
 	}
 
 	if err := storageSession.push(); err != nil {
 		// The lock already aquired by someone else
-		if strings.HasPrefix(err.Error(), git.ErrNonFastForwardUpdate.Error()) {
+		if storageSession.rejectedAsNonFastForward(lockBranchName, err) {
 			return types.ErrLockingConflict
 		}
 
 		return err
 	}
 
+	params.revision = storageSession.headRevision()
+
+	storageSession.mirrorLock(params, false)
+
 	return nil
 }
 
@@ -178,7 +254,7 @@ func (storageClient *StorageClient) LockState(p types.RequestMetadataParams, loc
 func (storageClient *StorageClient) ReadStateLock(p types.RequestMetadataParams) ([]byte, error) {
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
 
 	if err := storageSession.fetch(locksRefSpecs); err != nil {
 		return nil, err
@@ -210,15 +286,22 @@ func (storageClient *StorageClient) ReadStateLock(p types.RequestMetadataParams)
 	return lock, nil
 }
 
-// UnLockState for Git storage type, unlocking is a simple branch deleting remotely
+// UnLockState for Git storage type, unlocking is a simple branch deleting remotely (and on mirrors, with git.mirrorLocks)
 func (storageClient *StorageClient) UnLockState(p types.RequestMetadataParams) error {
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
+
+	if err := storageSession.checkLockMirrors(); err != nil {
+		return err
+	}
 
 	if err := storageSession.deleteBranch(getLockBranchName(params), true); err != nil {
 		return err
 	}
+	params.revision = ""
+
+	storageSession.mirrorLock(params, true)
 
 	return nil
 }
@@ -233,12 +316,13 @@ func (storageClient *StorageClient) ForceUnLockWorkaroundMessage(p types.Request
 
 // GetState will checkout into Ref, pull the latest from remote, and try to read the state file from there.
 // Will return ErrStateDidNotExisted if the state file did not existed.
+// If the state file is an LFS pointer, the content is downloaded from LFS.
 func (storageClient *StorageClient) GetState(p types.RequestMetadataParams) ([]byte, error) {
 	var state []byte
 
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
 
 	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
 		return state, err
@@ -250,22 +334,30 @@ func (storageClient *StorageClient) GetState(p types.RequestMetadataParams) ([]b
 
 	state, err := storageSession.readFile(params.State)
 	if err != nil {
-		if err == os.ErrNotExist {
+		if errors.Is(err, os.ErrNotExist) {
 			return state, types.ErrStateDidNotExisted
 		}
 		return state, err
 	}
 
-	return state, nil
+	return storageSession.lfsResolve(state)
 }
 
 // UpdateState write the state to storage.
 // It will checkout the Ref, pull the latest and try to add and commit the state in the request.
 // The file in repository will either be created or overwritten.
+// If something else has pushed to the Ref in the meantime, it will be retried on top of that, see retryPush.
+// With git.lfs, the state is uploaded to LFS first and only the pointer to it is committed, along with .gitattributes tracking it.
+// Once pushed, the Ref is pushed to mirrors, see checkMirrors and pushMirrors.
 func (storageClient *StorageClient) UpdateState(p types.RequestMetadataParams, state []byte) error {
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
+
+	state, err := storageSession.lfsStore(state)
+	if err != nil {
+		return err
+	}
 
 	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
 		return err
@@ -275,6 +367,28 @@ func (storageClient *StorageClient) UpdateState(p types.RequestMetadataParams, s
 		return err
 	}
 
+	if err := storageSession.checkMirrors(); err != nil {
+		return err
+	}
+
+	if err := storageSession.retryPush(params, func() error {
+		return storageSession.pushState(params, state)
+	}); err != nil {
+		return err
+	}
+
+	params.revision = storageSession.headRevision()
+
+	storageSession.mirrorBranch(params, params.Ref)
+
+	return nil
+}
+
+// pushState adds the state to the currently checked out Ref, commits and pushes it.
+// With Amend, the last commit is amended instead and force-pushed with a lease,
+// as long as that commit was made by this backend and was an update of this state and nothing else - so no one else's changes are discarded.
+// Otherwise it is committed on top as usual, and the next update will be amending that.
+func (storageSession *storageSession) pushState(params *RequestMetadataParams, state []byte) error {
 	if err := storageSession.writeFile(params.State, state); err != nil {
 		return err
 	}
@@ -283,36 +397,55 @@ func (storageClient *StorageClient) UpdateState(p types.RequestMetadataParams, s
 		return err
 	}
 
-	switch params.Amend {
-	case true:
-		if err := storageSession.commitAmend("Update " + params.State); err != nil {
+	if viper.GetBool("git.lfs") {
+		if err := storageSession.lfsTrack(params.State); err != nil {
 			return err
 		}
+	}
 
-		if err := storageSession.pushForce(); err != nil {
+	if params.Amend {
+		head, err := storageSession.repository.Head()
+		if err != nil {
 			return err
 		}
 
-	default:
-		if err := storageSession.commit("Update " + params.State); err != nil {
+		amendable, err := storageSession.committedByBackend(head.Hash())
+		if err != nil {
 			return err
 		}
 
-		if err := storageSession.push(); err != nil {
-			return err
+		if amendable {
+			if amendable, err = storageSession.onlyChanges(params.Ref, head.Hash(), params.State); err != nil {
+				return err
+			}
 		}
+
+		if amendable {
+			if err := storageSession.commitAmend(params, "Update"); err != nil {
+				return err
+			}
+
+			// If the Ref has moved remotely since the pull, the lease breaks and the push is retried on top of it
+			return storageSession.pushForceWithLease(params.Ref, head.Hash())
+		}
+
+		log.Printf("Last commit on %s is not an update of %s made by this backend, committing on top of it instead of amending", params.Ref, params.State)
 	}
 
-	return nil
+	if err := storageSession.commit(params, "Update"); err != nil {
+		return err
+	}
+
+	return storageSession.push()
 }
 
 // DeleteState delete the state from storage
 // Checkout the Ref, pull the latest and attempt to delete the state file from there.
-// Then commit and push.
+// Then commit and push, and push the Ref to mirrors.
 func (storageClient *StorageClient) DeleteState(p types.RequestMetadataParams) error {
 	params := p.(*RequestMetadataParams)
 
-	storageSession := storageClient.sessions[params.Repository]
+	storageSession := params.session
 
 	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
 		return err
@@ -322,18 +455,28 @@ func (storageClient *StorageClient) DeleteState(p types.RequestMetadataParams) e
 		return err
 	}
 
-	if err := storageSession.delete(params.State); err != nil {
+	if err := storageSession.checkMirrors(); err != nil {
 		return err
 	}
 
-	if err := storageSession.commit("Delete " + params.State); err != nil {
-		return err
-	}
+	if err := storageSession.retryPush(params, func() error {
+		if err := storageSession.delete(params.State); err != nil {
+			return err
+		}
 
-	if err := storageSession.push(); err != nil {
+		if err := storageSession.commit(params, "Delete"); err != nil {
+			return err
+		}
+
+		return storageSession.push()
+	}); err != nil {
 		return err
 	}
 
+	params.revision = storageSession.headRevision()
+
+	storageSession.mirrorBranch(params, params.Ref)
+
 	return nil
 }
 
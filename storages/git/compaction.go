@@ -0,0 +1,404 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// historyEntry is a commit on Ref along with what it changed compared to it's first parent
+type historyEntry struct {
+	commit  *object.Commit
+	changes object.Changes
+}
+
+// changePath is the path to the file changed, added or deleted
+func changePath(change *object.Change) string {
+	if change.To.Name != "" {
+		return change.To.Name
+	}
+	return change.From.Name
+}
+
+// PlanStateHistoryCompaction fetches complete history of Ref and finds the states that would lose versions with this policy.
+// Every file on Ref selected by the policy is considered a state, and every commit that changed it - a version of it.
+// Other files on Ref, i.e. README, are left with all their history.
+func (storageClient *StorageClient) PlanStateHistoryCompaction(p types.RequestMetadataParams, policy types.CompactionPolicy) (*types.CompactionPlan, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
+		return nil, err
+	}
+
+	if err := storageSession.pull(params.Ref); err != nil {
+		return nil, err
+	}
+
+	if err := storageSession.fetchHistory(params.Ref); err != nil {
+		return nil, err
+	}
+
+	head, err := storageSession.repository.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := storageSession.linearHistory(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	_, plan := planCompaction(history, policy)
+	plan.Revision = head.Hash().String()
+
+	return plan, nil
+}
+
+// CompactStateHistory rewrites Ref dropping versions of the states that are not kept by the plan policy, and force-pushes it with a lease.
+// Commits before the first dropped version are left as they were, the rest are re-created with original author and message,
+// and the backend as a committer. If commit signing is set up, re-created commits are signed.
+//
+// It is re-planned against the latest Ref, as other states might have been updated since the plan was made,
+// but if it finds that some state not in the original plan would lose versions now - it fails, as that state was not locked.
+// If Ref moves again while the history is being rewritten, the lease breaks and it starts over, see retryPush.
+func (storageClient *StorageClient) CompactStateHistory(p types.RequestMetadataParams, locked *types.CompactionPlan) (*types.CompactionPlan, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	if err := storageSession.checkout(params.Ref, CheckoutModeDefault); err != nil {
+		return nil, err
+	}
+
+	if err := storageSession.pull(params.Ref); err != nil {
+		return nil, err
+	}
+
+	if err := storageSession.fetchHistory(params.Ref); err != nil {
+		return nil, err
+	}
+
+	if err := storageSession.checkMirrors(); err != nil {
+		return nil, err
+	}
+
+	lockedStates := make(map[string]bool)
+	for _, state := range locked.States {
+		lockedStates[state.State] = true
+	}
+
+	var plan *types.CompactionPlan
+	err := storageSession.retryPush(params, func() error {
+		head, err := storageSession.repository.Head()
+		if err != nil {
+			return err
+		}
+
+		history, err := storageSession.linearHistory(head.Hash())
+		if err != nil {
+			return err
+		}
+
+		var kept []map[string]bool
+		kept, plan = planCompaction(history, locked.Policy)
+		plan.Revision = head.Hash().String()
+
+		for _, state := range plan.States {
+			if !lockedStates[state.State] {
+				return fmt.Errorf("State %s has changed since the compaction was planned, try again", state.State)
+			}
+		}
+
+		if len(plan.States) == 0 {
+			return nil
+		}
+
+		tip, err := storageSession.rewriteHistory(params, history, kept)
+		if err != nil {
+			return err
+		}
+
+		tree, err := storageSession.repository.Worktree()
+		if err != nil {
+			return err
+		}
+
+		if err := tree.Reset(&git.ResetOptions{
+			Commit: tip,
+			Mode:   git.HardReset,
+		}); err != nil {
+			return err
+		}
+
+		log.Printf("Compacted history of %s in %s from %s to %s", params.Ref, params.Repository, head.Hash(), tip)
+		plan.Revision = tip.String()
+
+		return storageSession.pushForceWithLease(params.Ref, head.Hash())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(plan.States) > 0 {
+		storageSession.mirrorBranch(params, params.Ref)
+	}
+
+	return plan, nil
+}
+
+// linearHistory walks the first parents from the commit down to the root, and returns them oldest first.
+// History must have been fetched completely beforehand.
+func (storageSession *storageSession) linearHistory(hash plumbing.Hash) ([]historyEntry, error) {
+	commits := make([]*object.Commit, 0)
+	for {
+		commit, err := storageSession.repository.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		commits = append(commits, commit)
+		if commit.NumParents() == 0 {
+			break
+		}
+		hash = commit.ParentHashes[0]
+	}
+
+	history := make([]historyEntry, 0, len(commits))
+	parentTree := &object.Tree{}
+	for i := len(commits) - 1; i >= 0; i-- {
+		tree, err := commits[i].Tree()
+		if err != nil {
+			return nil, err
+		}
+
+		changes, err := object.DiffTree(parentTree, tree)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, historyEntry{commit: commits[i], changes: changes})
+		parentTree = tree
+	}
+
+	return history, nil
+}
+
+// compacted checks if the file at path is one of the states the policy selects for compaction
+func compacted(policy types.CompactionPolicy, path string) bool {
+	for _, state := range policy.States {
+		if path == state || (strings.HasSuffix(state, "/") && strings.HasPrefix(path, state)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// planCompaction decides which versions of each state are kept with this policy.
+// For every commit in the history, it returns a set of paths which changes in that commit are kept.
+// All changes to files that are not selected by the policy are kept.
+func planCompaction(history []historyEntry, policy types.CompactionPolicy) ([]map[string]bool, *types.CompactionPlan) {
+	versions := make(map[string][]int)
+	for i, entry := range history {
+		for _, change := range entry.changes {
+			path := changePath(change)
+			versions[path] = append(versions[path], i)
+		}
+	}
+
+	paths := make([]string, 0, len(versions))
+	for path := range versions {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	kept := make([]map[string]bool, len(history))
+	for i := range kept {
+		kept[i] = make(map[string]bool)
+	}
+
+	plan := &types.CompactionPlan{
+		Policy: policy,
+		States: make([]types.StateCompaction, 0),
+	}
+	for _, path := range paths {
+		indexes := versions[path]
+
+		count := 0
+		for n, i := range indexes {
+			// Zero is the latest version
+			age := len(indexes) - 1 - n
+			if !compacted(policy, path) ||
+				age == 0 ||
+				(policy.Keep > 0 && age < policy.Keep) ||
+				(!policy.Since.IsZero() && history[i].commit.Author.When.After(policy.Since)) {
+				kept[i][path] = true
+				count++
+			}
+		}
+
+		if count < len(indexes) {
+			plan.States = append(plan.States, types.StateCompaction{
+				State:    path,
+				Versions: len(indexes),
+				Kept:     count,
+			})
+		}
+	}
+
+	return kept, plan
+}
+
+// rewriteHistory re-creates the history only applying changes that are kept, and returns the new tip.
+// Commits that are left with no changes are dropped. The tree of the new tip is the same as it was.
+func (storageSession *storageSession) rewriteHistory(params *RequestMetadataParams, history []historyEntry, kept []map[string]bool) (plumbing.Hash, error) {
+	data, err := newCommitTemplateData(params, "Compact")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	_, committer, err := data.commitSignatures()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	signer, err := commitSigner()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	files := make(map[string]object.TreeEntry)
+
+	// Before the root commit there was an empty tree
+	parent := plumbing.ZeroHash
+	parentTree, err := storageSession.writeTree(files)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	rewritten := false
+	for i, entry := range history {
+		all := true
+		for _, change := range entry.changes {
+			path := changePath(change)
+			if !kept[i][path] {
+				all = false
+				continue
+			}
+
+			if change.To.Name == "" {
+				delete(files, path)
+			} else {
+				files[path] = change.To.TreeEntry
+			}
+		}
+
+		// Nothing has been dropped so far - the commit can be left as it was
+		if all && !rewritten {
+			parent, parentTree = entry.commit.Hash, entry.commit.TreeHash
+			continue
+		}
+		rewritten = true
+
+		treeHash, err := storageSession.writeTree(files)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		if len(entry.changes) > 0 && treeHash == parentTree {
+			continue
+		}
+
+		commit := &object.Commit{
+			Author:    entry.commit.Author,
+			Committer: *committer,
+			Message:   entry.commit.Message,
+			TreeHash:  treeHash,
+		}
+		if !parent.IsZero() {
+			commit.ParentHashes = []plumbing.Hash{parent}
+		}
+
+		if signer != nil {
+			encoded := &plumbing.MemoryObject{}
+			if err := commit.EncodeWithoutSignature(encoded); err != nil {
+				return plumbing.ZeroHash, err
+			}
+			reader, err := encoded.Reader()
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			signature, err := signer.Sign(reader)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			commit.PGPSignature = string(signature)
+		}
+
+		hash, err := storageSession.storeObject(commit)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		parent, parentTree = hash, treeHash
+	}
+
+	if tip := history[len(history)-1].commit; parentTree != tip.TreeHash {
+		return plumbing.ZeroHash, fmt.Errorf("Compacted history of %s does not end with the same tree as %s", params.Ref, tip.Hash)
+	}
+
+	return parent, nil
+}
+
+// writeTree stores the tree with these files, keyed by their path, along with all subtrees - and returns the root tree hash.
+func (storageSession *storageSession) writeTree(files map[string]object.TreeEntry) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	dirs := make(map[string]map[string]object.TreeEntry)
+	for path, entry := range files {
+		if i := strings.Index(path, "/"); i >= 0 {
+			dir := path[:i]
+			if dirs[dir] == nil {
+				dirs[dir] = make(map[string]object.TreeEntry)
+			}
+			dirs[dir][path[i+1:]] = entry
+			continue
+		}
+
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: path, Mode: entry.Mode, Hash: entry.Hash})
+	}
+
+	for dir, files := range dirs {
+		hash, err := storageSession.writeTree(files)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+
+	sort.Sort(object.TreeEntrySorter(tree.Entries))
+
+	return storageSession.storeObject(tree)
+}
+
+// storeObject encodes the object into the repository storage
+func (storageSession *storageSession) storeObject(o interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	obj := storageSession.repository.Storer.NewEncodedObject()
+	if err := o.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return storageSession.repository.Storer.SetEncodedObject(obj)
+}
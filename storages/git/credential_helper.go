@@ -0,0 +1,250 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/viper"
+)
+
+const (
+	// credentialHelperCacheTTL is how long credentials from the helper are re-used before asking it again,
+	// unless they expire sooner. Git calls the helper once per command, and we are doing a lot of them.
+	credentialHelperCacheTTL = time.Minute
+
+	// credentialHelperTimeout is how long the helper has to respond
+	credentialHelperTimeout = 30 * time.Second
+)
+
+// credentialHelperCommand makes the command to run the helper the same way git does it.
+// See https://git-scm.com/docs/gitcredentials#_custom_helpers.
+func credentialHelperCommand(ctx context.Context, helper, action string) *exec.Cmd {
+	switch {
+	case strings.HasPrefix(helper, "!"):
+		helper = helper[1:]
+	case strings.HasPrefix(helper, "/"):
+	default:
+		helper = "git credential-" + helper
+	}
+
+	return exec.CommandContext(ctx, "sh", "-c", helper+` "$@"`, helper, action)
+}
+
+// credentialHelperInput describes the remote to the helper.
+// For store and erase, it also has the credentials in question.
+func credentialHelperInput(u *url.URL, auth *http.BasicAuth) []byte {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "protocol=%s\n", u.Scheme)
+	fmt.Fprintf(&input, "host=%s\n", u.Host)
+	if viper.GetBool("git.credentialUseHttpPath") {
+		fmt.Fprintf(&input, "path=%s\n", strings.TrimPrefix(u.Path, "/"))
+	}
+	if auth != nil {
+		fmt.Fprintf(&input, "username=%s\n", auth.Username)
+		fmt.Fprintf(&input, "password=%s\n", auth.Password)
+	} else if u.User != nil && u.User.Username() != "" {
+		fmt.Fprintf(&input, "username=%s\n", u.User.Username())
+	}
+	input.WriteString("\n")
+
+	return input.Bytes()
+}
+
+// runCredentialHelper runs the helper action with the input and returns what it printed
+func runCredentialHelper(helper, action string, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := credentialHelperCommand(ctx, helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Helpers must not prompt, there is no one to answer
+	cmd.Env = append(cmd.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Git credential helper %q failed to %s: %w: %s", helper, action, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+type cachedCredentialHelper struct {
+	helper   string
+	url      *url.URL
+	auth     *http.BasicAuth
+	expires  time.Time
+	approved bool
+}
+
+type credentialHelperCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedCredentialHelper
+}
+
+var credentialHelpers = &credentialHelperCache{entries: make(map[string]cachedCredentialHelper)}
+
+// get asks the helper for credentials for the remote URL.
+// Returns nil if the helper did not have any.
+// Same as git, if the helper fails, it is logged and treated as if it had no credentials.
+func (cache *credentialHelperCache) get(helper, remoteURL string) (*http.BasicAuth, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	input := credentialHelperInput(u, nil)
+	key := helper + "\x00" + string(input)
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	cache.mu.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(entry.expires) {
+		return entry.auth, nil
+	}
+
+	stdout, err := runCredentialHelper(helper, "get", input)
+	if err != nil {
+		log.Print(err)
+		return nil, nil
+	}
+
+	var auth *http.BasicAuth
+	expires := now.Add(credentialHelperCacheTTL)
+
+	output := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(stdout))
+	for scanner.Scan() {
+		if kv := strings.SplitN(scanner.Text(), "=", 2); len(kv) == 2 {
+			output[kv[0]] = kv[1]
+		}
+	}
+
+	if output["password"] != "" {
+		auth = &http.BasicAuth{Username: output["username"], Password: output["password"]}
+		if auth.Username == "" && u.User != nil {
+			auth.Username = u.User.Username()
+		}
+
+		if expiry, err := strconv.ParseInt(output["password_expiry_utc"], 10, 64); err == nil {
+			if t := time.Unix(expiry, 0); t.Before(expires) {
+				expires = t
+			}
+		}
+	}
+
+	cache.mu.Lock()
+	cache.entries[key] = cachedCredentialHelper{helper: helper, url: u, auth: auth, expires: expires}
+	cache.mu.Unlock()
+
+	return auth, nil
+}
+
+// approve tells the helper these credentials worked, so it can store them, like git does after a successful command.
+// Each set of credentials is only stored once, not on every command.
+func (cache *credentialHelperCache) approve(auth *http.BasicAuth) {
+	if auth == nil {
+		return
+	}
+
+	cache.mu.Lock()
+	var approved []cachedCredentialHelper
+	for key, entry := range cache.entries {
+		if entry.auth == auth && !entry.approved {
+			entry.approved = true
+			cache.entries[key] = entry
+			approved = append(approved, entry)
+		}
+	}
+	cache.mu.Unlock()
+
+	for _, entry := range approved {
+		if _, err := runCredentialHelper(entry.helper, "store", credentialHelperInput(entry.url, entry.auth)); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// reject tells the helper these credentials were rejected, so it can erase them, like git does after authentication fails.
+// They are dropped from the cache, so the helper is asked again next time.
+func (cache *credentialHelperCache) reject(auth *http.BasicAuth) {
+	if auth == nil {
+		return
+	}
+
+	cache.mu.Lock()
+	var rejected []cachedCredentialHelper
+	for key, entry := range cache.entries {
+		if entry.auth == auth {
+			delete(cache.entries, key)
+			rejected = append(rejected, entry)
+		}
+	}
+	cache.mu.Unlock()
+
+	for _, entry := range rejected {
+		log.Printf("Credentials of %s from Git credential helper %q were rejected by %s", entry.auth.Username, entry.helper, entry.url.Redacted())
+		if _, err := runCredentialHelper(entry.helper, "erase", credentialHelperInput(entry.url, entry.auth)); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// reportCredentials lets the credential helper know how the remote operation went with the credentials it gave us.
+// Credentials that did not come from a helper are ignored.
+func reportCredentials(auth transport.AuthMethod, err error) {
+	basicAuth, ok := auth.(*http.BasicAuth)
+	if !ok {
+		return
+	}
+
+	switch {
+	case err == nil || errors.Is(err, git.NoErrAlreadyUpToDate):
+		credentialHelpers.approve(basicAuth)
+	case errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed):
+		credentialHelpers.reject(basicAuth)
+	}
+}
+
+// authCredentialHelper asks git.credentialHelper for the credentials for the remote URL, if it was configured.
+// Returns nil if it was not, or if the helper did not have any credentials.
+func authCredentialHelper(remoteURL string) (*http.BasicAuth, error) {
+	helper := viper.GetString("git.credentialHelper")
+	if helper == "" {
+		return nil, nil
+	}
+
+	return credentialHelpers.get(helper, remoteURL)
+}
+
+// authHTTP discovers HTTP credentials for the remote URL.
+// Unless GIT_USERNAME was set explicitly, the credential helper is asked first.
+func authHTTP(remoteURL string) (*http.BasicAuth, error) {
+	if _, ok := os.LookupEnv("GIT_USERNAME"); !ok {
+		auth, err := authCredentialHelper(remoteURL)
+		if err != nil {
+			return nil, err
+		}
+		if auth != nil {
+			return auth, nil
+		}
+	}
+
+	return authBasicHTTP()
+}
@@ -0,0 +1,163 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	sshGit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	sshagent "github.com/xanzy/ssh-agent"
+)
+
+// credentialsEntry is an entry of git.credentials, it tells how to authenticate to repositories matching the pattern.
+// Environment variables are not used at all for these repositories, unless the entry only has HTTPS options.
+type credentialsEntry struct {
+	// Repository is the URL pattern, * matches any number of any characters
+	Repository string `mapstructure:"repository"`
+
+	// HTTP credentials, either static or from the helper
+	Username         string `mapstructure:"username"`
+	Password         string `mapstructure:"password"`
+	PasswordFile     string `mapstructure:"passwordFile"`
+	CredentialHelper string `mapstructure:"credentialHelper"`
+
+	// SSH credentials, agent is preferred if it was enabled and available
+	SSHAgent             bool     `mapstructure:"sshAgent"`
+	SSHKey               []string `mapstructure:"sshKey"`
+	SSHKeyPassphrase     string   `mapstructure:"sshKeyPassphrase"`
+	SSHKeyPassphraseFile string   `mapstructure:"sshKeyPassphraseFile"`
+
+	// HTTPS options, see httpsOptions
+	CABundle   string `mapstructure:"caBundle"`
+	ClientCert string `mapstructure:"clientCert"`
+	ClientKey  string `mapstructure:"clientKey"`
+	Proxy      string `mapstructure:"proxy"`
+}
+
+// hasCredentials checks if the entry has any credentials, otherwise it only sets HTTPS options
+func (entry *credentialsEntry) hasCredentials() bool {
+	return entry.Username != "" || entry.CredentialHelper != "" || entry.SSHAgent || len(entry.SSHKey) > 0
+}
+
+// matches checks if the repository URL matches the pattern
+func (entry *credentialsEntry) matches(repository string) bool {
+	pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(entry.Repository), `\*`, ".*") + "$"
+	return regexp.MustCompile(pattern).MatchString(repository)
+}
+
+// repositoryCredentials finds the first git.credentials entry matching any of the repository URLs,
+// i.e. the URL as configured and the one it was resolved to with insteadOf rules and SSH config.
+// If returned null - none matched, and credentials are to be discovered in the environment, same as if the entry had none.
+func repositoryCredentials(repositories ...string) (*credentialsEntry, error) {
+	var entries []credentialsEntry
+	if err := viper.UnmarshalKey("git.credentials", &entries); err != nil {
+		return nil, fmt.Errorf("Failed to parse git.credentials: %w", err)
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Repository == "" {
+			return nil, fmt.Errorf("Entry %d in git.credentials has no repository pattern", i)
+		}
+		for _, repository := range repositories {
+			if entry.matches(repository) {
+				return entry, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// authHTTP makes HTTP credentials for the remote URL, i.e. the repository itself or its LFS server
+func (entry *credentialsEntry) authHTTP(remoteURL string) (*http.BasicAuth, error) {
+	if entry.CredentialHelper != "" {
+		auth, err := credentialHelpers.get(entry.CredentialHelper, remoteURL)
+		if err != nil {
+			return nil, err
+		}
+		if auth == nil {
+			return nil, fmt.Errorf("Git credential helper %q had no credentials for %s (git.credentials %s)", entry.CredentialHelper, remoteURL, entry.Repository)
+		}
+		return auth, nil
+	}
+
+	if entry.Username == "" {
+		return nil, fmt.Errorf("No HTTP credentials for %s (git.credentials %s)", remoteURL, entry.Repository)
+	}
+
+	password := entry.Password
+	if password == "" && entry.PasswordFile != "" {
+		v, err := credentialFiles.readTrimmed(entry.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = v
+	}
+	if password == "" {
+		return nil, fmt.Errorf("Neither password nor password file was set for %s (git.credentials %s)", remoteURL, entry.Repository)
+	}
+
+	return &http.BasicAuth{
+		Username: entry.Username,
+		Password: password,
+	}, nil
+}
+
+// authSSH makes SSH credentials for the endpoint
+func (entry *credentialsEntry) authSSH(e *transport.Endpoint) (*sshGit.PublicKeysCallback, error) {
+	if entry.SSHAgent && sshagent.Available() {
+		return sshGit.NewSSHAgentAuth(e.User)
+	}
+
+	if len(entry.SSHKey) == 0 {
+		if entry.SSHAgent {
+			return nil, fmt.Errorf("SSH agent is not available for %s (git.credentials %s)", e.Host, entry.Repository)
+		}
+		return nil, fmt.Errorf("No SSH credentials for %s (git.credentials %s)", e.Host, entry.Repository)
+	}
+
+	files := make([]string, 0, len(entry.SSHKey))
+	for _, file := range entry.SSHKey {
+		file, err := homedir.Expand(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	passphrase := entry.SSHKeyPassphrase
+	if passphrase == "" && entry.SSHKeyPassphraseFile != "" {
+		v, err := credentialFiles.readTrimmed(entry.SSHKeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = v
+	}
+
+	return sshPublicKeys(e, files, true, passphrase)
+}
+
+// credentialsHashKey is random for each backend process, so hashes of credentials can't be brute-forced outside of it
+var credentialsHashKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// credentialsHash identifies credentials passed through by the caller without revealing them, i.e. in session keys that are logged
+func credentialsHash(credentials *http.BasicAuth) string {
+	mac := hmac.New(sha256.New, credentialsHashKey)
+	mac.Write([]byte(credentials.Username + "\x00" + credentials.Password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -2,12 +2,16 @@ package git
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
-	"os/user"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -15,15 +19,18 @@ import (
 	sshagent "github.com/xanzy/ssh-agent"
 
 	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	sshGit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/go-git/go-git/v5/storage/memory"
-	"golang.org/x/crypto/ssh"
+	"github.com/spf13/viper"
 
 	"github.com/plumber-cd/terraform-backend-git/backend"
 )
@@ -32,7 +39,7 @@ func init() {
 	backend.KnownStorageTypes["git"] = NewStorageClient()
 }
 
-// authHTTP discovers environment for HTTP credentials
+// authBasicHTTP discovers environment for HTTP credentials
 func authBasicHTTP() (*http.BasicAuth, error) {
 	username, okUsername := os.LookupEnv("GIT_USERNAME")
 	if !okUsername {
@@ -98,38 +105,51 @@ func authSSHAgent(params *RequestMetadataParams) (*sshGit.PublicKeysCallback, er
 	return sshGit.NewSSHAgentAuth(e.User)
 }
 
-// authSSH discovers environment for SSH credentials
-func authSSH() (*sshGit.PublicKeys, error) {
-	pemFile, okPem := os.LookupEnv("SSH_PRIVATE_KEY")
-	if !okPem {
-		// Ok then, try to discover SSH keys in the user home
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return nil, err
-		}
-
-		pemFile = home + "/.ssh/id_rsa"
+// authSSH discovers environment for SSH credentials.
+// All keys found are offered in order, along with their certificates.
+func authSSH(params *RequestMetadataParams) (*sshGit.PublicKeysCallback, error) {
+	e, err := transport.NewEndpoint(params.Repository)
+	if err != nil {
+		return nil, err
 	}
 
-	pem, err := ioutil.ReadFile(pemFile)
+	files, explicit, err := sshKeyFiles(e)
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(pem)
+	passphrase, err := sshKeyPassphrase()
 	if err != nil {
 		return nil, err
 	}
 
-	return &sshGit.PublicKeys{User: "git", Signer: signer}, nil
+	return sshPublicKeys(e, files, explicit, passphrase)
 }
 
-// auth discovers Git authentification in the environment
-func auth(params *RequestMetadataParams) (transport.AuthMethod, error) {
-	// If protocol was HTTP, try to discover Basic auth methods from the environment
+// auth discovers Git authentification in the environment.
+// Repositories are the URLs params.Repository was resolved from, git.credentials entries are matched against them as well.
+func auth(params *RequestMetadataParams, repositories ...string) (transport.AuthMethod, error) {
+	// Local repositories do not need any authentification
+	if e, err := transport.NewEndpoint(params.Repository); err == nil && e.Protocol == "file" {
+		return nil, nil
+	}
+
+	// Credentials set for the repository in the config file take precedence over the environment
+	entry, err := repositoryCredentials(append(repositories, params.Repository)...)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.hasCredentials() {
+		entry = nil
+	}
+
+	// If protocol was HTTP, try to discover Basic auth methods from the credential helper or the environment
 	if strings.HasPrefix(params.Repository, "http") {
-		// Otherwise we assume protocol was SSH.
-		auth, err := authBasicHTTP()
+		if entry != nil {
+			return entry.authHTTP(params.Repository)
+		}
+
+		auth, err := authHTTP(params.Repository)
 		if err != nil {
 			return nil, err
 		}
@@ -139,13 +159,24 @@ func auth(params *RequestMetadataParams) (transport.AuthMethod, error) {
 
 	// Otherwise we assume protocol was SSH
 
-	// Most likely strict known hosts checking not needed, but not making any assumptions
-	strictHostKeyChecking := true
-	hostKeyCallbackHelper := sshGit.HostKeyCallbackHelper{
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	e, err := transport.NewEndpoint(params.Repository)
+	if err != nil {
+		return nil, err
 	}
-	if val, ok := os.LookupEnv("StrictHostKeyChecking"); ok && val == "no" {
-		strictHostKeyChecking = false
+
+	hostKeyCallbackHelper, err := hostKeyCallbackHelper(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil {
+		key, err := entry.authSSH(e)
+		if err != nil {
+			return nil, err
+		}
+
+		key.HostKeyCallbackHelper = hostKeyCallbackHelper
+		return key, nil
 	}
 
 	// First, try ssh agent
@@ -154,21 +185,17 @@ func auth(params *RequestMetadataParams) (transport.AuthMethod, error) {
 		return nil, err
 	}
 	if agent != nil {
-		if !strictHostKeyChecking {
-			agent.HostKeyCallbackHelper = hostKeyCallbackHelper
-		}
+		agent.HostKeyCallbackHelper = hostKeyCallbackHelper
 		return agent, nil
 	}
 
 	// Otherwise, try to find some ssh keys
-	key, err := authSSH()
+	key, err := authSSH(params)
 	if err != nil {
 		return nil, err
 	}
 
-	if !strictHostKeyChecking {
-		key.HostKeyCallbackHelper = hostKeyCallbackHelper
-	}
+	key.HostKeyCallbackHelper = hostKeyCallbackHelper
 
 	return key, nil
 }
@@ -184,32 +211,188 @@ func ref(branch string, remote bool) plumbing.ReferenceName {
 	return plumbing.ReferenceName(ref + branch)
 }
 
-// newStorageSession makes a fresh clone to in-memory FS and saves everything to the StorageSession
-func newStorageSession(params *RequestMetadataParams) (*storageSession, error) {
+// newStorageSession prepares the StorageSession.
+// By default it will be using in-memory FS, unless git.cacheDir was set - then a subdirectory on disk will be used.
+// Sessions with credentials passed through by the caller are always in-memory, so nothing fetched with them outlives the backend.
+// It doesn't clone anything yet - it's up to the caller to connect it while holding the session mutex.
+func newStorageSession(key string, params *RequestMetadataParams) (*storageSession, error) {
+	remoteURL, err := resolveRepository(params.Repository)
+	if err != nil {
+		return nil, err
+	}
+
 	storageSession := &storageSession{
-		remoteURL: params.Repository,
-		storer:    memory.NewStorage(),
-		fs:        memfs.New(),
-		mutex:     sync.Mutex{},
+		key:           key,
+		repositoryURL: params.Repository,
+		remoteURL:     remoteURL,
+		credentials:   params.credentials,
+		mutex:         sync.Mutex{},
+		lastUsed:      time.Now(),
 	}
 
-	if err := storageSession.clone(params); err != nil {
+	if cacheDir := viper.GetString("git.cacheDir"); cacheDir != "" && params.credentials == nil {
+		hash := sha256.Sum256([]byte(key))
+		storageSession.dir = filepath.Join(cacheDir, hex.EncodeToString(hash[:]))
+	}
+
+	if err := storageSession.initStorage(); err != nil {
 		return nil, err
 	}
 
 	return storageSession, nil
 }
 
+// initStorage prepares the storer and the working tree FS for this session.
+// On disk, it will pick up whatever was previously stored in the session directory.
+func (storageSession *storageSession) initStorage() error {
+	storageSession.repository = nil
+
+	if storageSession.dir == "" {
+		storageSession.storer = memory.NewStorage()
+		storageSession.fs = memfs.New()
+		return nil
+	}
+
+	if err := os.MkdirAll(storageSession.dir, 0700); err != nil {
+		return err
+	}
+
+	storageSession.fs = osfs.New(storageSession.dir)
+	storageSession.storer = filesystem.NewStorage(osfs.New(filepath.Join(storageSession.dir, git.GitDirName)), cache.NewObjectLRUDefault())
+
+	return nil
+}
+
+// resetStorage drops everything that was stored in this session so far and prepares an empty storage for a fresh clone.
+func (storageSession *storageSession) resetStorage() error {
+	storageSession.closeStorage()
+
+	if storageSession.dir != "" {
+		if err := os.RemoveAll(storageSession.dir); err != nil {
+			return err
+		}
+	}
+
+	return storageSession.initStorage()
+}
+
+// closeStorage releases files held open by the storer, if any
+func (storageSession *storageSession) closeStorage() {
+	if closer, ok := storageSession.storer.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close session storage in %s: %s", storageSession.dir, err)
+		}
+	}
+}
+
+// connect makes the session ready to use - it will either re-use a clone from the disk cache or make a fresh clone.
+// If anything goes wrong, the storage will be reset so the next attempt would start from scratch.
+func (storageSession *storageSession) connect(params *RequestMetadataParams) error {
+	if ok := storageSession.open(params); ok {
+		return nil
+	}
+
+	if err := storageSession.clone(params); err != nil {
+		if resetErr := storageSession.resetStorage(); resetErr != nil {
+			log.Printf("Failed to reset session storage for %s: %s", params.Repository, resetErr)
+		}
+		return err
+	}
+
+	storageSession.clonedAt = time.Now()
+	storageSession.saveClonedAt()
+
+	return nil
+}
+
+// open a repository previously cloned to the cache directory.
+// Returns false if there was nothing usable in the cache, so it needs to be cloned.
+// The working tree might be left in any state by a previous backend instance,
+// but that doesn't matter since every operation starts with forced checkout and pull.
+func (storageSession *storageSession) open(params *RequestMetadataParams) bool {
+	if storageSession.dir == "" {
+		return false
+	}
+
+	repository, err := git.Open(storageSession.storer, storageSession.fs)
+	if err != nil {
+		if err != git.ErrRepositoryNotExists {
+			log.Printf("Ignoring broken cache for %s in %s: %s", params.Repository, storageSession.dir, err)
+			storageSession.discardCache()
+		}
+		return false
+	}
+
+	remote, err := repository.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != storageSession.remoteURL {
+		log.Printf("Ignoring cache in %s as it is not a clone of %s", storageSession.dir, params.Repository)
+		storageSession.discardCache()
+		return false
+	}
+
+	storageSession.repository = repository
+	storageSession.clonedAt = storageSession.loadClonedAt()
+
+	return true
+}
+
+// clonedAtPath is where the time of the clone is kept in the cache directory, so it survives restarts
+func (storageSession *storageSession) clonedAtPath() string {
+	return filepath.Join(storageSession.dir, git.GitDirName, "terraform-backend-git-cloned-at")
+}
+
+// saveClonedAt records the time of the clone in the cache directory, if any
+func (storageSession *storageSession) saveClonedAt() {
+	if storageSession.dir == "" {
+		return
+	}
+
+	if err := os.WriteFile(storageSession.clonedAtPath(), []byte(storageSession.clonedAt.Format(time.RFC3339Nano)), 0600); err != nil {
+		log.Printf("Failed to record clone time in %s: %s", storageSession.dir, err)
+	}
+}
+
+// loadClonedAt reads the time of the clone from the cache directory.
+// Caches without that record are treated as if they were cloned just now.
+func (storageSession *storageSession) loadClonedAt() time.Time {
+	if buf, err := os.ReadFile(storageSession.clonedAtPath()); err == nil {
+		if clonedAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(buf))); err == nil {
+			return clonedAt
+		}
+	}
+
+	storageSession.clonedAt = time.Now()
+	storageSession.saveClonedAt()
+
+	return storageSession.clonedAt
+}
+
+// discardCache is resetStorage that only logs errors, next clone would fail anyway if the cache directory is unusable.
+func (storageSession *storageSession) discardCache() {
+	if err := storageSession.resetStorage(); err != nil {
+		log.Printf("Failed to reset session storage in %s: %s", storageSession.dir, err)
+	}
+}
+
 // clone remote repository
 func (storageSession *storageSession) clone(params *RequestMetadataParams) error {
-	auth, err := auth(params)
+	auth, err := storageSession.remoteAuth()
+	if err != nil {
+		return err
+	}
+
+	https, err := remoteHTTPSOptions(storageSession.remoteURL, storageSession.repositoryURL)
 	if err != nil {
 		return err
 	}
 
 	cloneOptions := &git.CloneOptions{
-		URL:           params.Repository,
+		URL:           storageSession.remoteURL,
 		Auth:          auth,
+		CABundle:      https.caBundle,
+		ClientCert:    https.clientCert,
+		ClientKey:     https.clientKey,
+		ProxyOptions:  https.proxy,
 		ReferenceName: ref(params.Ref, false),
 		// We only need to know the latest version of branches to be able to commit on top
 		// of them. And, we don't otherwise use the history of the repository. So, this
@@ -223,6 +406,7 @@ func (storageSession *storageSession) clone(params *RequestMetadataParams) error
 	}
 
 	repository, err := git.Clone(storageSession.storer, storageSession.fs, cloneOptions)
+	reportCredentials(auth, err)
 	if err != nil {
 		return err
 	}
@@ -243,12 +427,20 @@ func (storageSession *storageSession) getRemote() (*git.Remote, error) {
 	return remote, nil
 }
 
+// remoteAuth discovers credentials for the remote, unless the caller has passed through theirs
 func (storageSession *storageSession) remoteAuth() (transport.AuthMethod, error) {
 	if storageSession.remoteURL == "" {
 		return nil, errors.New("Remote repository URL is not set")
 	}
 
-	return auth(&RequestMetadataParams{Repository: storageSession.remoteURL})
+	if storageSession.credentials != nil {
+		if !strings.HasPrefix(storageSession.remoteURL, "http") {
+			return nil, fmt.Errorf("Credentials can only be passed through to HTTP repositories, %s is not", storageSession.remoteURL)
+		}
+		return storageSession.credentials, nil
+	}
+
+	return auth(&RequestMetadataParams{Repository: storageSession.remoteURL}, storageSession.repositoryURL)
 }
 
 // CheckoutMode configures checkout behaviour
@@ -291,6 +483,7 @@ func (storageSession *storageSession) checkout(branch string, mode CheckoutMode)
 // Attempt to pull from remote to the current branch.
 // This branch must already exist locally and upstream must be set for it to know where to pull from.
 // It will ignore git.NoErrAlreadyUpToDate.
+// If the remote branch has been rewritten, i.e. by the history compaction, local branch is reset to it.
 func (storageSession *storageSession) pull(branch string) error {
 	auth, err := storageSession.remoteAuth()
 	if err != nil {
@@ -302,13 +495,28 @@ func (storageSession *storageSession) pull(branch string) error {
 		return err
 	}
 
+	https, err := remoteHTTPSOptions(storageSession.remoteURL, storageSession.repositoryURL)
+	if err != nil {
+		return err
+	}
+
 	pullOptions := git.PullOptions{
 		ReferenceName: ref(branch, false),
 		Force:         true,
 		Auth:          auth,
-	}
-
-	if err := tree.Pull(&pullOptions); err != nil && err != git.NoErrAlreadyUpToDate {
+		CABundle:      https.caBundle,
+		ClientCert:    https.clientCert,
+		ClientKey:     https.clientKey,
+		ProxyOptions:  https.proxy,
+	}
+
+	err = tree.Pull(&pullOptions)
+	reportCredentials(auth, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		// Remote branch was rewritten, or go-git could not tell as it ran into the shallow clone boundary looking for our head in it
+		if isNonFastForward(err) || (err == plumbing.ErrObjectNotFound && storageSession.isShallow()) {
+			return storageSession.resetToRemote(branch)
+		}
 		return err
 	}
 
@@ -324,14 +532,112 @@ var (
 // Attempt to fetch from remote for specified ref specs.
 // It will ignore git.NoErrAlreadyUpToDate.
 func (storageSession *storageSession) fetch(refs []config.RefSpec) error {
+	return storageSession.fetchWithOptions(git.FetchOptions{RefSpecs: refs})
+}
+
+// Attempt to fetch complete history of the branch from remote, turning shallow clone into a full one.
+// It will ignore git.NoErrAlreadyUpToDate.
+func (storageSession *storageSession) fetchHistory(branch string) error {
+	if err := storageSession.fetchWithOptions(git.FetchOptions{
+		RefSpecs: []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("+%s:%s", ref(branch, false), ref(branch, true))),
+		},
+		Depth: math.MaxInt32,
+	}); err != nil {
+		return err
+	}
+
+	return storageSession.unshallow()
+}
+
+// remoteHead lists the branch on the remote and returns the commit it points to, or zero hash if there is no such branch
+func (storageSession *storageSession) remoteHead(branch string) (plumbing.Hash, error) {
+	remote, err := storageSession.getRemote()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
 	auth, err := storageSession.remoteAuth()
 	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	https, err := remoteHTTPSOptions(storageSession.remoteURL, storageSession.repositoryURL)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	refs, err := remote.List(&git.ListOptions{
+		Auth:         auth,
+		CABundle:     https.caBundle,
+		ClientCert:   https.clientCert,
+		ClientKey:    https.clientKey,
+		ProxyOptions: https.proxy,
+	})
+	reportCredentials(auth, err)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	for _, r := range refs {
+		if r.Name() == ref(branch, false) {
+			return r.Hash(), nil
+		}
+	}
+
+	return plumbing.ZeroHash, nil
+}
+
+// isShallow checks if the local repository is still a shallow clone
+func (storageSession *storageSession) isShallow() bool {
+	shallows, err := storageSession.repository.Storer.Shallow()
+	return err == nil && len(shallows) > 0
+}
+
+// unshallow forgets shallow clone boundaries that are no longer there, as go-git does not do it on fetch.
+// On push, go-git assumes the remote has boundary commits and never sends them,
+// so they must be forgotten once we have their history in order to push it somewhere it was not yet.
+func (storageSession *storageSession) unshallow() error {
+	shallows, err := storageSession.repository.Storer.Shallow()
+	if err != nil || len(shallows) == 0 {
 		return err
 	}
 
-	fetchOptions := git.FetchOptions{
-		RefSpecs: refs,
-		Auth:     auth,
+	remaining := make([]plumbing.Hash, 0, len(shallows))
+	for _, shallow := range shallows {
+		commit, err := storageSession.repository.CommitObject(shallow)
+		if err != nil {
+			return err
+		}
+
+		complete := true
+		for _, parent := range commit.ParentHashes {
+			if _, err := storageSession.repository.Storer.EncodedObject(plumbing.CommitObject, parent); err != nil {
+				complete = false
+				break
+			}
+		}
+		if !complete {
+			remaining = append(remaining, shallow)
+		}
+	}
+
+	if len(remaining) == len(shallows) {
+		return nil
+	}
+
+	return storageSession.repository.Storer.SetShallow(remaining)
+}
+
+func (storageSession *storageSession) fetchWithOptions(opts git.FetchOptions) error {
+	auth, err := storageSession.remoteAuth()
+	if err != nil {
+		return err
+	}
+
+	https, err := remoteHTTPSOptions(storageSession.remoteURL, storageSession.repositoryURL)
+	if err != nil {
+		return err
 	}
 
 	remote, err := storageSession.getRemote()
@@ -339,7 +645,14 @@ func (storageSession *storageSession) fetch(refs []config.RefSpec) error {
 		return err
 	}
 
-	if err := remote.Fetch(&fetchOptions); err != nil && err != git.NoErrAlreadyUpToDate {
+	opts.Auth = auth
+	opts.CABundle = https.caBundle
+	opts.ClientCert = https.clientCert
+	opts.ClientKey = https.clientKey
+	opts.ProxyOptions = https.proxy
+	err = remote.Fetch(&opts)
+	reportCredentials(auth, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
 		return err
 	}
 
@@ -360,24 +673,11 @@ func (storageSession *storageSession) deleteBranch(branch string, deleteRemote b
 		return nil
 	}
 
-	remote, err := storageSession.getRemote()
-	if err != nil {
-		return err
-	}
-
-	auth, err := storageSession.remoteAuth()
-	if err != nil {
-		return err
-	}
-
-	pushOptions := &git.PushOptions{
+	if err := storageSession.pushWithOptions(git.PushOptions{
 		RefSpecs: []config.RefSpec{
 			config.RefSpec(":" + ref),
 		},
-		Auth: auth,
-	}
-
-	if err := remote.Push(pushOptions); err != nil && err != git.NoErrAlreadyUpToDate {
+	}); err != nil && err != git.NoErrAlreadyUpToDate {
 		return err
 	}
 
@@ -412,43 +712,54 @@ func (storageSession *storageSession) delete(path string) error {
 	return nil
 }
 
-// commit currently staged changes to the local working tree
-func (storageSession *storageSession) commit(msg string) error {
-	return storageSession.commitWithOptions(msg, git.CommitOptions{})
+// amendTrailer marks state updates made in amend mode, so they can be amended by the next update
+const amendTrailer = "Terraform-Backend-Git: amend"
+
+// commit currently staged changes to the local working tree, action is what this commit does - Lock, Update or Delete
+func (storageSession *storageSession) commit(params *RequestMetadataParams, action string) error {
+	return storageSession.commitWithOptions(params, action, "", git.CommitOptions{})
 }
 
 // commit --amend currently staged changes to the local working tree
-func (storageSession *storageSession) commitAmend(msg string) error {
+func (storageSession *storageSession) commitAmend(params *RequestMetadataParams, action string) error {
 	plumbing, _ := storageSession.repository.Head()
-	return storageSession.commitWithOptions(fmt.Sprintf("%s (amendment of %s)", msg, plumbing.Hash().String()), git.CommitOptions{Amend: true})
+	return storageSession.commitWithOptions(params, action, fmt.Sprintf(" (amendment of %s)", plumbing.Hash().String()), git.CommitOptions{Amend: true})
 }
 
-func (storageSession *storageSession) commitWithOptions(msg string, opts git.CommitOptions) error {
-	user, err := user.Current()
+// commitWithOptions commits with message, author and committer from the templates.
+// Suffix is appended to the message as-is.
+func (storageSession *storageSession) commitWithOptions(params *RequestMetadataParams, action, suffix string, opts git.CommitOptions) error {
+	data, err := newCommitTemplateData(params, action)
 	if err != nil {
 		return err
 	}
 
-	userName := user.Name
-	if userName == "" {
-		userName = user.Username
+	msg, err := data.commitMessage()
+	if err != nil {
+		return err
 	}
 
-	host, err := os.Hostname()
+	opts.Author, opts.Committer, err = data.commitSignatures()
 	if err != nil {
 		return err
 	}
 
-	opts.Author = &object.Signature{
-		Name:  userName,
-		Email: user.Username + "@" + host,
-		When:  time.Now(),
+	signer, err := commitSigner()
+	if err != nil {
+		return err
 	}
+	opts.Signer = signer
 
 	tree, err := storageSession.repository.Worktree()
 	if err != nil {
 		return err
 	}
+	msg += suffix
+	if params.Amend && action == "Update" {
+		// Identity and message are rendered per request and may change, so the commit is marked to recognize it later
+		msg = strings.TrimRight(msg, "\n") + "\n\n" + amendTrailer + "\n"
+	}
+
 	if _, err := tree.Commit(msg, &opts); err != nil {
 		return err
 	}
@@ -462,8 +773,18 @@ func (storageSession *storageSession) push() error {
 	return storageSession.pushWithOptions(git.PushOptions{})
 }
 
-func (storageSession *storageSession) pushForce() error {
-	return storageSession.pushWithOptions(git.PushOptions{Force: true})
+// pushForceWithLease force-pushes the branch, as long as it still points to the expected commit remotely.
+// Only this branch is pushed - with a lease, go-git would not check other branches and just force-push them.
+func (storageSession *storageSession) pushForceWithLease(branch string, expected plumbing.Hash) error {
+	return storageSession.pushWithOptions(git.PushOptions{
+		RefSpecs: []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("%s:%s", ref(branch, false), ref(branch, false))),
+		},
+		ForceWithLease: &git.ForceWithLease{
+			RefName: ref(branch, false),
+			Hash:    expected,
+		},
+	})
 }
 
 func (storageSession *storageSession) pushWithOptions(opts git.PushOptions) error {
@@ -477,8 +798,98 @@ func (storageSession *storageSession) pushWithOptions(opts git.PushOptions) erro
 		return err
 	}
 
+	https, err := remoteHTTPSOptions(storageSession.remoteURL, storageSession.repositoryURL)
+	if err != nil {
+		return err
+	}
+
 	opts.Auth = auth
-	return remote.Push(&opts)
+	opts.CABundle = https.caBundle
+	opts.ClientCert = https.clientCert
+	opts.ClientKey = https.clientKey
+	opts.ProxyOptions = https.proxy
+	err = remote.Push(&opts)
+	reportCredentials(auth, err)
+	return err
+}
+
+// committedByBackend returns true if the commit is an update made by this backend in amend mode, marked with amendTrailer.
+// Commits made by anyone else are never amended, even if they only changed the state.
+func (storageSession *storageSession) committedByBackend(hash plumbing.Hash) (bool, error) {
+	commit, err := storageSession.repository.CommitObject(hash)
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(commit.Message, "\n") {
+		if strings.TrimSpace(line) == amendTrailer {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// onlyChanges returns true if the commit has a single parent and changes nothing but the file at path.
+// In a shallow clone the parent might be missing, then the branch is fetched deep enough to have it.
+func (storageSession *storageSession) onlyChanges(branch string, hash plumbing.Hash, path string) (bool, error) {
+	commit, err := storageSession.repository.CommitObject(hash)
+	if err != nil {
+		return false, err
+	}
+
+	if commit.NumParents() != 1 {
+		return false, nil
+	}
+
+	parent, err := commit.Parent(0)
+	if err == plumbing.ErrObjectNotFound {
+		if err := storageSession.fetchWithOptions(git.FetchOptions{
+			RefSpecs: []config.RefSpec{
+				config.RefSpec(fmt.Sprintf("+%s:%s", ref(branch, false), ref(branch, true))),
+			},
+			Depth: 2,
+		}); err != nil {
+			return false, err
+		}
+		parent, err = commit.Parent(0)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return false, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return false, err
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return false, err
+	}
+
+	for _, change := range changes {
+		if change.From.Name != path && change.To.Name != path {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// headRevision is the hash of the commit currently checked out, or an empty string if there's none
+func (storageSession *storageSession) headRevision() string {
+	head, err := storageSession.repository.Head()
+	if err != nil {
+		return ""
+	}
+
+	return head.Hash().String()
 }
 
 // fileExists returns true if file existed in the working tree
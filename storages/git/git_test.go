@@ -1,12 +1,42 @@
 package git
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/plumber-cd/terraform-backend-git/backend"
+	"github.com/plumber-cd/terraform-backend-git/types"
 )
 
 func TestAuthBasicHTTP_EnvPassword(t *testing.T) {
@@ -131,3 +161,2129 @@ func TestStorageSessionRemoteAuth_RefetchesTokenFile(t *testing.T) {
 		t.Fatalf("expected password %q, got %q", "tok2", ba2.Password)
 	}
 }
+
+func TestAuthHTTP_CredentialHelper(t *testing.T) {
+	// Helper must be asked only when GIT_USERNAME was not set explicitly
+	t.Setenv("GIT_USERNAME", "")
+	os.Unsetenv("GIT_USERNAME")
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	helper := filepath.Join(dir, "helper.sh")
+	script := "#!/bin/sh\n" +
+		"test \"$1\" = get || exit 1\n" +
+		"cat >> " + input + "\n" +
+		"echo username=helper\n" +
+		"echo password=secret\n"
+	if err := os.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+
+	viper.Set("git.credentialHelper", helper)
+	defer viper.Set("git.credentialHelper", "")
+	viper.Set("git.credentialUseHttpPath", true)
+	defer viper.Set("git.credentialUseHttpPath", false)
+
+	auth, err := authHTTP("https://example.invalid:8443/org/repo.git")
+	if err != nil {
+		t.Fatalf("authHTTP: %v", err)
+	}
+	if auth.Username != "helper" || auth.Password != "secret" {
+		t.Fatalf("expected credentials from the helper, got %q/%q", auth.Username, auth.Password)
+	}
+
+	got, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	if want := "protocol=https\nhost=example.invalid:8443\npath=org/repo.git\n\n"; string(got) != want {
+		t.Fatalf("expected helper input %q, got %q", want, got)
+	}
+
+	// Cached, the helper is not asked again
+	if _, err := authHTTP("https://example.invalid:8443/org/repo.git"); err != nil {
+		t.Fatalf("authHTTP: %v", err)
+	}
+	if got, _ := os.ReadFile(input); strings.Count(string(got), "protocol=") != 1 {
+		t.Fatalf("expected the helper to be asked once, input was %q", got)
+	}
+
+	// Explicit credentials take precedence
+	t.Setenv("GIT_USERNAME", "user")
+	t.Setenv("GIT_PASSWORD", "pass")
+	auth, err = authHTTP("https://example.invalid:8443/org/repo.git")
+	if err != nil {
+		t.Fatalf("authHTTP: %v", err)
+	}
+	if auth.Username != "user" || auth.Password != "pass" {
+		t.Fatalf("expected credentials from the environment, got %q/%q", auth.Username, auth.Password)
+	}
+}
+
+func TestAuthHTTP_CredentialHelperFailure(t *testing.T) {
+	t.Setenv("GIT_USERNAME", "")
+	os.Unsetenv("GIT_USERNAME")
+
+	viper.Set("git.credentialHelper", "!echo denied >&2; exit 1")
+	defer viper.Set("git.credentialHelper", "")
+
+	// Same as git, failed helper is skipped and variables are used as usual
+	_, err := authHTTP("https://example.invalid/repo.git")
+	if err == nil || !strings.Contains(err.Error(), "GIT_USERNAME") {
+		t.Fatalf("expected to fall back to the environment, got %v", err)
+	}
+}
+
+func TestReportCredentials(t *testing.T) {
+	t.Setenv("GIT_USERNAME", "")
+	os.Unsetenv("GIT_USERNAME")
+
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	helper := filepath.Join(dir, "helper.sh")
+	script := "#!/bin/sh\n" +
+		"echo \"$1\" >> " + calls + "\n" +
+		"cat >> " + calls + "\n" +
+		"test \"$1\" = get || exit 0\n" +
+		"echo username=helper\n" +
+		"echo password=revoked\n"
+	if err := os.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatalf("write helper: %v", err)
+	}
+
+	viper.Set("git.credentialHelper", helper)
+	defer viper.Set("git.credentialHelper", "")
+
+	const remoteURL = "https://report.example.invalid/repo.git"
+	auth, err := authHTTP(remoteURL)
+	if err != nil {
+		t.Fatalf("authHTTP: %v", err)
+	}
+
+	// Stored once, not on every command
+	reportCredentials(auth, nil)
+	reportCredentials(auth, git.NoErrAlreadyUpToDate)
+
+	// Rejected are erased and dropped from the cache
+	reportCredentials(auth, fmt.Errorf("clone: %w", transport.ErrAuthenticationRequired))
+	if _, err := authHTTP(remoteURL); err != nil {
+		t.Fatalf("authHTTP: %v", err)
+	}
+
+	got, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("read calls: %v", err)
+	}
+	want := "get\nprotocol=https\nhost=report.example.invalid\n\n" +
+		"store\nprotocol=https\nhost=report.example.invalid\nusername=helper\npassword=revoked\n\n" +
+		"erase\nprotocol=https\nhost=report.example.invalid\nusername=helper\npassword=revoked\n\n" +
+		"get\nprotocol=https\nhost=report.example.invalid\n\n"
+	if string(got) != want {
+		t.Fatalf("expected helper calls %q, got %q", want, got)
+	}
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+
+	return key
+}
+
+func TestHostKeyCallbackHelper(t *testing.T) {
+	t.Setenv("StrictHostKeyChecking", "")
+	os.Unsetenv("StrictHostKeyChecking")
+
+	e, err := transport.NewEndpoint("ssh://git@example.com:2222/org/repo.git")
+	if err != nil {
+		t.Fatalf("endpoint: %v", err)
+	}
+	hostname := "example.com:2222"
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+	key, otherKey := newTestHostKey(t), newTestHostKey(t)
+
+	check := func(key ssh.PublicKey) error {
+		t.Helper()
+		helper, err := hostKeyCallbackHelper(e)
+		if err != nil {
+			t.Fatalf("hostKeyCallbackHelper: %v", err)
+		}
+		return helper.HostKeyCallback(hostname, remote, key)
+	}
+
+	knownHosts := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	viper.Set("git.knownHosts", []string{knownHosts})
+	defer viper.Set("git.knownHosts", nil)
+
+	// Unknown host is rejected by default, and there's nothing to check against yet
+	if _, err := hostKeyCallbackHelper(e); err == nil {
+		t.Fatal("expected error without known_hosts")
+	}
+
+	// Recorded on first use with accept-new, then known
+	viper.Set("git.strictHostKeyChecking", hostKeyCheckingAcceptNew)
+	defer viper.Set("git.strictHostKeyChecking", "")
+	if err := check(key); err != nil {
+		t.Fatalf("expected new host key to be accepted, got %v", err)
+	}
+	content, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if !strings.HasPrefix(string(content), "[example.com]:2222,[127.0.0.1]:2222 ssh-ed25519 ") {
+		t.Fatalf("unexpected known_hosts %q", content)
+	}
+
+	viper.Set("git.strictHostKeyChecking", hostKeyCheckingYes)
+	if err := check(key); err != nil {
+		t.Fatalf("expected recorded host key to be accepted, got %v", err)
+	}
+	helper, err := hostKeyCallbackHelper(e)
+	if err != nil {
+		t.Fatalf("hostKeyCallbackHelper: %v", err)
+	}
+	if len(helper.HostKeyAlgorithms) == 0 || helper.HostKeyAlgorithms[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected known key algorithm first, got %v", helper.HostKeyAlgorithms)
+	}
+
+	// Changed key is never accepted
+	for _, mode := range []string{hostKeyCheckingYes, hostKeyCheckingAcceptNew} {
+		viper.Set("git.strictHostKeyChecking", mode)
+		if err := check(otherKey); err == nil {
+			t.Fatalf("expected changed host key to be rejected with %s", mode)
+		}
+	}
+
+	// Pinned fingerprints take precedence over known_hosts
+	viper.Set("git.hostKeyFingerprints", []string{"[example.com]:2222=" + ssh.FingerprintSHA256(otherKey)})
+	defer viper.Set("git.hostKeyFingerprints", nil)
+	if err := check(otherKey); err != nil {
+		t.Fatalf("expected pinned host key to be accepted, got %v", err)
+	}
+	if err := check(key); err == nil {
+		t.Fatal("expected host key that is not pinned to be rejected")
+	}
+	viper.Set("git.hostKeyFingerprints", []string{"example.com " + ssh.FingerprintSHA256(otherKey)})
+	if _, err := hostKeyCallbackHelper(e); err == nil {
+		t.Fatal("expected error for invalid fingerprint entry")
+	}
+	viper.Set("git.hostKeyFingerprints", nil)
+
+	// Legacy environment variable still disables the check, unless the config says otherwise
+	viper.Set("git.strictHostKeyChecking", "")
+	t.Setenv("StrictHostKeyChecking", "no")
+	if err := check(otherKey); err != nil {
+		t.Fatalf("expected any host key to be accepted, got %v", err)
+	}
+	// Unknown legacy values used to check host keys, they must not start failing now
+	t.Setenv("StrictHostKeyChecking", "true")
+	if err := check(key); err != nil {
+		t.Fatalf("expected known host key to be accepted, got %v", err)
+	}
+	if err := check(otherKey); err == nil {
+		t.Fatal("expected unknown host key to be rejected")
+	}
+	viper.Set("git.strictHostKeyChecking", "maybe")
+	if _, err := hostKeyCallbackHelper(e); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+// writeTestSSHKey writes a new ed25519 private key to the file, encrypted if passphrase was given
+func writeTestSSHKey(t *testing.T, file, passphrase string) ssh.Signer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	}
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+
+	return signer
+}
+
+// writeTestSSHCert issues a certificate for the key next to it, as ssh-keygen -s would do
+func writeTestSSHCert(t *testing.T, file string, key ssh.Signer, validBefore time.Time) {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate CA key: %v", err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("CA signer: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"git"},
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign cert: %v", err)
+	}
+	if err := os.WriteFile(file+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+}
+
+func TestAuthSSH(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_PRIVATE_KEY", "")
+
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("write passphrase: %v", err)
+	}
+	t.Setenv("SSH_PRIVATE_KEY_PASSPHRASE_FILE", passphraseFile)
+
+	ed25519Key := writeTestSSHKey(t, filepath.Join(home, ".ssh", "id_ed25519"), "secret")
+	rsaKey := writeTestSSHKey(t, filepath.Join(home, ".ssh", "id_rsa"), "")
+	writeTestSSHCert(t, filepath.Join(home, ".ssh", "id_ed25519"), ed25519Key, time.Now().Add(time.Hour))
+
+	params := &RequestMetadataParams{Repository: "ssh://deploy@example.com/org/repo.git"}
+
+	signers := func() []ssh.Signer {
+		t.Helper()
+		auth, err := authSSH(params)
+		if err != nil {
+			t.Fatalf("authSSH: %v", err)
+		}
+		if auth.User != "deploy" {
+			t.Fatalf("expected user from the URL, got %q", auth.User)
+		}
+		signers, err := auth.Callback()
+		if err != nil {
+			t.Fatalf("callback: %v", err)
+		}
+		return signers
+	}
+
+	// Certificate first, then the keys in the order they were discovered
+	got := signers()
+	if len(got) != 3 {
+		t.Fatalf("expected 3 signers, got %d", len(got))
+	}
+	cert, ok := got[0].PublicKey().(*ssh.Certificate)
+	if !ok || !bytes.Equal(cert.Key.Marshal(), ed25519Key.PublicKey().Marshal()) {
+		t.Fatalf("expected certificate of id_ed25519 first, got %s", got[0].PublicKey().Type())
+	}
+	for i, expected := range []ssh.Signer{ed25519Key, rsaKey} {
+		if !bytes.Equal(got[i+1].PublicKey().Marshal(), expected.PublicKey().Marshal()) {
+			t.Fatalf("unexpected signer %d", i+1)
+		}
+	}
+
+	// Expired certificate is not offered
+	writeTestSSHCert(t, filepath.Join(home, ".ssh", "id_ed25519"), ed25519Key, time.Now().Add(-time.Hour))
+	if got := signers(); len(got) != 2 {
+		t.Fatalf("expected 2 signers without expired certificate, got %d", len(got))
+	}
+
+	// Discovered keys that can't be used are skipped
+	t.Setenv("SSH_PRIVATE_KEY_PASSPHRASE", "")
+	os.Unsetenv("SSH_PRIVATE_KEY_PASSPHRASE_FILE")
+	if got := signers(); len(got) != 1 || !bytes.Equal(got[0].PublicKey().Marshal(), rsaKey.PublicKey().Marshal()) {
+		t.Fatal("expected only the key that is not encrypted")
+	}
+
+	// But not the ones that were explicitly set, all of them must exist
+	t.Setenv("SSH_PRIVATE_KEY", filepath.Join(home, ".ssh", "id_rsa")+string(filepath.ListSeparator)+filepath.Join(home, ".ssh", "id_ed25519"))
+	if _, err := authSSH(params); err == nil || !strings.Contains(err.Error(), "SSH_PRIVATE_KEY_PASSPHRASE") {
+		t.Fatalf("expected error about missing passphrase, got %v", err)
+	}
+	t.Setenv("SSH_PRIVATE_KEY_PASSPHRASE", "secret")
+	if got := signers(); len(got) != 2 || !bytes.Equal(got[0].PublicKey().Marshal(), rsaKey.PublicKey().Marshal()) {
+		t.Fatal("expected explicit keys in the given order")
+	}
+	t.Setenv("SSH_PRIVATE_KEY", filepath.Join(home, ".ssh", "id_ecdsa"))
+	if _, err := authSSH(params); err == nil {
+		t.Fatal("expected error for missing key")
+	}
+}
+
+func TestResolveRepository(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("GIT_CONFIG_GLOBAL", "")
+	os.Unsetenv("GIT_CONFIG_GLOBAL")
+	t.Setenv("SSH_PRIVATE_KEY", "")
+
+	repository := newTestRepository(t)
+
+	gitConfig := `[url "github-work:"]
+	insteadOf = gh:
+	insteadOf = https://github.com/
+[url "ssh://git@github.com:2222/my-org/"]
+	insteadOf = https://github.com/my-org/
+[url "` + repository + `"]
+	insteadOf = local:state
+`
+	if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitConfig), 0600); err != nil {
+		t.Fatalf("write gitconfig: %v", err)
+	}
+
+	sshConfig := `Host github-work
+  HostName github.com
+  Port 2222
+  User work
+  IdentityFile ~/.ssh/work_%h
+`
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "config"), []byte(sshConfig), 0600); err != nil {
+		t.Fatalf("write ssh config: %v", err)
+	}
+
+	for in, expected := range map[string]string{
+		"gh:org/states.git":                    "work@github-work:org/states.git",
+		"https://github.com/org/states.git":    "work@github-work:org/states.git",
+		"https://github.com/my-org/states.git": "ssh://git@github.com:2222/my-org/states.git",
+		"deploy@github-work:org/states.git":    "deploy@github-work:org/states.git",
+		"ssh://github-work/org/states.git":     "ssh://work@github-work/org/states.git",
+		"https://gitlab.com/org/states.git":    "https://gitlab.com/org/states.git",
+	} {
+		actual, err := resolveRepository(in)
+		if err != nil {
+			t.Fatalf("resolveRepository(%s): %v", in, err)
+		}
+		if actual != expected {
+			t.Fatalf("expected %s to resolve to %s, got %s", in, expected, actual)
+		}
+	}
+
+	e, err := transport.NewEndpoint("work@github-work:org/states.git")
+	if err != nil {
+		t.Fatalf("endpoint: %v", err)
+	}
+	if actual := sshHostWithPort(e); actual != "github.com:2222" {
+		t.Fatalf("expected github.com:2222, got %s", actual)
+	}
+	files, explicit, err := sshKeyFiles(e)
+	if err != nil {
+		t.Fatalf("sshKeyFiles: %v", err)
+	}
+	if expected := filepath.Join(home, ".ssh", "work_github.com"); explicit || len(files) != 1 || files[0] != expected {
+		t.Fatalf("expected IdentityFile %s, got %v", expected, files)
+	}
+	if endpoint, err := lfsEndpoint("work@github-work:org/states.git"); err != nil || endpoint != "https://github.com/org/states.git/info/lfs" {
+		t.Fatalf("unexpected LFS endpoint %s: %v", endpoint, err)
+	}
+
+	// Session clones the rewritten URL
+	params := &RequestMetadataParams{Repository: "local:state", Ref: "master", State: "state.json"}
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	if err := client.UpdateState(params, []byte("v1")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if remoteLog(t, repository)[0] != "Update state.json" {
+		t.Fatal("expected the state to be pushed to the rewritten URL")
+	}
+}
+
+func TestRepositoryCredentials(t *testing.T) {
+	t.Setenv("GIT_USERNAME", "env")
+	t.Setenv("GIT_PASSWORD", "env")
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("write password: %v", err)
+	}
+	key := writeTestSSHKey(t, filepath.Join(dir, "deploy"), "secret")
+
+	viper.Set("git.credentials", []map[string]interface{}{
+		{"repository": "https://github.com/my-org/infra.git", "username": "infra", "passwordFile": passwordFile},
+		{"repository": "https://github.com/my-org/*", "credentialHelper": "!f() { echo username=helper; echo password=secret; }; f"},
+		{"repository": "git@github.com:my-org/*", "sshKey": filepath.Join(dir, "deploy"), "sshKeyPassphrase": "secret"},
+	})
+	defer viper.Set("git.credentials", nil)
+
+	// First matching entry wins
+	for repository, expected := range map[string]string{
+		"https://github.com/my-org/infra.git":    "https://github.com/my-org/infra.git",
+		"https://github.com/my-org/team/x.git":   "https://github.com/my-org/*",
+		"git@github.com:my-org/state.git":        "git@github.com:my-org/*",
+		"https://github.com/other-org/infra.git": "",
+	} {
+		entry, err := repositoryCredentials(repository)
+		if err != nil {
+			t.Fatalf("repositoryCredentials(%s): %v", repository, err)
+		}
+		if (entry == nil && expected != "") || (entry != nil && entry.Repository != expected) {
+			t.Fatalf("expected %s to match %q, got %+v", repository, expected, entry)
+		}
+	}
+
+	basicAuth := func(repository string) *githttp.BasicAuth {
+		t.Helper()
+		a, err := auth(&RequestMetadataParams{Repository: repository})
+		if err != nil {
+			t.Fatalf("auth(%s): %v", repository, err)
+		}
+		return a.(*githttp.BasicAuth)
+	}
+
+	// Entries take precedence over the environment, that is only used for repositories not matching any of them
+	if a := basicAuth("https://github.com/my-org/infra.git"); a.Username != "infra" || a.Password != "from-file" {
+		t.Fatalf("expected credentials from the password file, got %q/%q", a.Username, a.Password)
+	}
+	if a := basicAuth("https://github.com/my-org/app.git"); a.Username != "helper" || a.Password != "secret" {
+		t.Fatalf("expected credentials from the helper, got %q/%q", a.Username, a.Password)
+	}
+	if a := basicAuth("https://github.com/other-org/infra.git"); a.Username != "env" || a.Password != "env" {
+		t.Fatalf("expected credentials from the environment, got %q/%q", a.Username, a.Password)
+	}
+
+	// SSH entry has no HTTP credentials
+	entry, _ := repositoryCredentials("git@github.com:my-org/state.git")
+	if _, err := entry.authHTTP("https://github.com/my-org/state.git"); err == nil {
+		t.Fatal("expected an error for the entry without HTTP credentials")
+	}
+
+	e, err := transport.NewEndpoint("git@github.com:my-org/state.git")
+	if err != nil {
+		t.Fatalf("endpoint: %v", err)
+	}
+	keys, err := entry.authSSH(e)
+	if err != nil {
+		t.Fatalf("authSSH: %v", err)
+	}
+	signers, err := keys.Callback()
+	if err != nil {
+		t.Fatalf("callback: %v", err)
+	}
+	if len(signers) != 1 || !bytes.Equal(signers[0].PublicKey().Marshal(), key.PublicKey().Marshal()) {
+		t.Fatal("expected the key from the entry")
+	}
+}
+
+func TestRemoteAuth_RewrittenRepository(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	os.Unsetenv("GIT_CONFIG_GLOBAL")
+	t.Setenv("GIT_USERNAME", "env")
+	t.Setenv("GIT_PASSWORD", "env")
+
+	gitConfig := `[url "https://git.my-org.com/"]
+	insteadOf = my-org:
+`
+	if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(gitConfig), 0600); err != nil {
+		t.Fatalf("write gitconfig: %v", err)
+	}
+
+	viper.Set("git.credentials", []map[string]interface{}{
+		{"repository": "my-org:infra/*", "username": "configured", "password": "secret"},
+		{"repository": "https://git.my-org.com/*", "username": "resolved", "password": "secret"},
+	})
+	defer viper.Set("git.credentials", nil)
+
+	// Entries are matched against the repository as configured, and the URL it was rewritten to
+	for repository, expected := range map[string]string{
+		"my-org:infra/states.git": "configured",
+		"my-org:app/states.git":   "resolved",
+	} {
+		session, err := newStorageSession(repository, &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"})
+		if err != nil {
+			t.Fatalf("session: %v", err)
+		}
+		if session.remoteURL != strings.Replace(repository, "my-org:", "https://git.my-org.com/", 1) {
+			t.Fatalf("expected %s to be rewritten, got %s", repository, session.remoteURL)
+		}
+
+		a, err := session.remoteAuth()
+		if err != nil {
+			t.Fatalf("remoteAuth: %v", err)
+		}
+		if a.(*githttp.BasicAuth).Username != expected {
+			t.Fatalf("expected %s credentials for %s, got %q", expected, repository, a.(*githttp.BasicAuth).Username)
+		}
+	}
+}
+
+// newTestRepository creates a bare repository on local FS with a single commit on master branch.
+// Each repository has its own root commit, so they don't share history by accident.
+func newTestRepository(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git binary is required for local file transport")
+	}
+
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "remote.git")
+	work := filepath.Join(dir, "work")
+
+	for _, args := range [][]string{
+		{"init", "--bare", "--initial-branch=master", bare},
+		{"init", "--initial-branch=master", work},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--allow-empty", "-m", "init", "-m", bare},
+		{"-C", work, "push", bare, "master"},
+	} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	return "file://" + filepath.ToSlash(bare)
+}
+
+func TestSessionKey(t *testing.T) {
+	params := &RequestMetadataParams{Repository: "git@example.com:org/repo.git", Ref: "main", State: "a/b.json"}
+
+	for mode, expected := range map[string]string{
+		"":                    "git@example.com:org/repo.git",
+		ConcurrencyRepository: "git@example.com:org/repo.git",
+		ConcurrencyRef:        "git@example.com:org/repo.git?ref=main",
+		ConcurrencyState:      "git@example.com:org/repo.git?ref=main//a/b.json",
+	} {
+		viper.Set("git.concurrency", mode)
+		key, err := sessionKey(params)
+		if err != nil {
+			t.Fatalf("mode %q: %v", mode, err)
+		}
+		if key != expected {
+			t.Fatalf("mode %q: expected key %q, got %q", mode, expected, key)
+		}
+	}
+
+	viper.Set("git.concurrency", "bogus")
+	defer viper.Set("git.concurrency", "")
+	if _, err := sessionKey(params); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestPassCredentials(t *testing.T) {
+	repository := newTestRepository(t)
+	client := NewStorageClient().(*StorageClient)
+
+	parse := func(credentials *types.Credentials) *RequestMetadataParams {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/?type=git&repository="+repository+"&state=a.json", nil)
+		if credentials != nil {
+			request = types.WithCredentials(request, credentials)
+		}
+		metadata := &types.RequestMetadata{}
+		if err := client.ParseMetadataParams(request, metadata); err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		return metadata.Params.(*RequestMetadataParams)
+	}
+
+	if params := parse(nil); params.credentials != nil {
+		t.Fatal("expected no credentials unless passed through")
+	}
+
+	alice := parse(&types.Credentials{Username: "alice", Password: "secret"})
+	if alice.credentials == nil || alice.credentials.Username != "alice" || alice.credentials.Password != "secret" {
+		t.Fatalf("expected credentials passed through, got %+v", alice.credentials)
+	}
+
+	// Each set of credentials gets its own sessions, and the key doesn't reveal them
+	key := func(params *RequestMetadataParams) string {
+		t.Helper()
+		key, err := sessionKey(params)
+		if err != nil {
+			t.Fatalf("session key: %v", err)
+		}
+		return key
+	}
+	aliceKey := key(alice)
+	if strings.Contains(aliceKey, "secret") || aliceKey == key(parse(nil)) {
+		t.Fatalf("unexpected session key %q", aliceKey)
+	}
+	if aliceKey != key(parse(&types.Credentials{Username: "alice", Password: "secret"})) {
+		t.Fatal("expected the same session for the same credentials")
+	}
+	if aliceKey == key(parse(&types.Credentials{Username: "alice", Password: "other"})) {
+		t.Fatal("expected another session for other credentials")
+	}
+
+	// Sessions that failed to connect with passed through credentials are not kept
+	if err := client.Connect(alice); err == nil || !strings.Contains(err.Error(), "only be passed through to HTTP") {
+		t.Fatalf("expected an error for non-HTTP repository, got %v", err)
+	}
+	if len(client.sessions) != 0 {
+		t.Fatalf("expected failed session to be evicted, got %d sessions", len(client.sessions))
+	}
+
+	// Passed through credentials take precedence over the backend's own, and are never cached on disk
+	t.Setenv("GIT_USERNAME", "backend")
+	t.Setenv("GIT_PASSWORD", "backend")
+	viper.Set("git.cacheDir", t.TempDir())
+	defer viper.Set("git.cacheDir", "")
+
+	params := &RequestMetadataParams{Repository: "https://example.invalid/org/repo.git", credentials: alice.credentials}
+	s, err := newStorageSession(key(params), params)
+	if err != nil {
+		t.Fatalf("new session: %v", err)
+	}
+	if s.dir != "" {
+		t.Fatalf("expected in-memory session, got %s", s.dir)
+	}
+	auth, err := s.remoteAuth()
+	if err != nil {
+		t.Fatalf("remoteAuth: %v", err)
+	}
+	if auth != alice.credentials {
+		t.Fatalf("expected passed through credentials, got %v", auth)
+	}
+}
+
+func TestConnect_StateConcurrency(t *testing.T) {
+	repository := newTestRepository(t)
+
+	viper.Set("git.concurrency", ConcurrencyState)
+	defer viper.Set("git.concurrency", "")
+
+	client := NewStorageClient()
+	first := &RequestMetadataParams{Repository: repository, Ref: "master", State: "first.json"}
+	second := &RequestMetadataParams{Repository: repository, Ref: "master", State: "second.json"}
+
+	if err := client.Connect(first); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(first)
+
+	connected := make(chan error, 1)
+	go func() {
+		connected <- client.Connect(second)
+	}()
+
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		defer client.Disconnect(second)
+	case <-time.After(30 * time.Second):
+		t.Fatalf("second state was blocked by the first one")
+	}
+
+	if err := client.UpdateState(second, []byte("second")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := client.UpdateState(first, []byte("first")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Each session must see updates made by the other one
+	for params, expected := range map[*RequestMetadataParams]string{
+		first:  "second",
+		second: "first",
+	} {
+		other := &RequestMetadataParams{Repository: repository, Ref: "master", State: expected + ".json", session: params.session}
+		state, err := client.GetState(other)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if string(state) != expected {
+			t.Fatalf("expected %q, got %q", expected, state)
+		}
+	}
+}
+
+func TestConnect_CacheDir(t *testing.T) {
+	repository := newTestRepository(t)
+
+	viper.Set("git.cacheDir", t.TempDir())
+	defer viper.Set("git.cacheDir", "")
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := client.UpdateState(params, []byte("cached")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	client.Disconnect(params)
+
+	// Make remote unreachable - the only way to connect now is to re-use the cache
+	remote := strings.TrimPrefix(repository, "file://")
+	if err := os.Rename(remote, remote+".moved"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	restarted := NewStorageClient()
+	if err := restarted.Connect(params); err != nil {
+		t.Fatalf("connect from cache: %v", err)
+	}
+	defer restarted.Disconnect(params)
+
+	state, err := params.session.readFile(params.State)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(state) != "cached" {
+		t.Fatalf("expected %q, got %q", "cached", state)
+	}
+}
+
+func TestGetState_CacheDirNotExisted(t *testing.T) {
+	repository := newTestRepository(t)
+
+	viper.Set("git.cacheDir", t.TempDir())
+	defer viper.Set("git.cacheDir", "")
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	// Working tree on disk reports missing files differently from the in-memory one
+	if _, err := client.GetState(params); err != types.ErrStateDidNotExisted {
+		t.Fatalf("expected ErrStateDidNotExisted, got %v", err)
+	}
+}
+
+func TestCleanupSessions_CacheDirReclone(t *testing.T) {
+	repository := newTestRepository(t)
+
+	viper.Set("git.cacheDir", t.TempDir())
+	defer viper.Set("git.cacheDir", "")
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	clonedAt := params.session.clonedAt
+	client.Disconnect(params)
+
+	// Session re-opened from the cache by a restarted backend must remember when it was cloned
+	restarted := NewStorageClient().(*StorageClient)
+	if err := restarted.Connect(params); err != nil {
+		t.Fatalf("connect from cache: %v", err)
+	}
+	session := params.session
+	restarted.Disconnect(params)
+	if !session.clonedAt.Equal(clonedAt) {
+		t.Fatalf("expected session to be cloned at %s, got %s", clonedAt, session.clonedAt)
+	}
+
+	limits := sessionsLimits{recloneInterval: time.Hour}
+	restarted.cleanupSessions(clonedAt.Add(30*time.Minute), limits)
+	if session.repository == nil {
+		t.Fatalf("expected session storage to be kept until reclone interval passes")
+	}
+
+	restarted.cleanupSessions(clonedAt.Add(2*time.Hour), limits)
+	if session.repository != nil {
+		t.Fatalf("expected session storage to be dropped after reclone interval")
+	}
+}
+
+func TestCleanupSessions(t *testing.T) {
+	repository := newTestRepository(t)
+
+	viper.Set("git.concurrency", ConcurrencyState)
+	defer viper.Set("git.concurrency", "")
+
+	client := NewStorageClient().(*StorageClient)
+	states := []string{"a.json", "b.json", "c.json"}
+	for i, state := range states {
+		params := &RequestMetadataParams{Repository: repository, Ref: "master", State: state}
+		if err := client.Connect(params); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		stats, err := params.session.stats()
+		if err != nil {
+			t.Fatalf("stats: %v", err)
+		}
+		if stats.objects == 0 || stats.bytes == 0 {
+			t.Fatalf("expected session to use some memory, got %+v", stats)
+		}
+		client.Disconnect(params)
+		params.session = client.sessions[repository+"?ref=master//"+state]
+		params.session.lastUsed = time.Now().Add(time.Duration(i-len(states)) * time.Hour)
+	}
+
+	busy := &RequestMetadataParams{Repository: repository, Ref: "master", State: "a.json"}
+	if err := client.Connect(busy); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	// a.json is the least recently used but it is busy, so b.json has to go instead
+	client.cleanupSessions(time.Now(), sessionsLimits{maxSessions: 2})
+	if len(client.sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(client.sessions))
+	}
+	if _, ok := client.sessions[repository+"?ref=master//b.json"]; ok {
+		t.Fatalf("expected b.json session to be evicted")
+	}
+
+	client.Disconnect(busy)
+
+	client.cleanupSessions(time.Now().Add(2*time.Minute), sessionsLimits{idleTimeout: time.Minute})
+	if len(client.sessions) != 0 {
+		t.Fatalf("expected all sessions to be evicted, got %d", len(client.sessions))
+	}
+
+	// Evicted sessions must be transparently re-created
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "a.json"}
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+	if _, err := client.GetState(params); err != types.ErrStateDidNotExisted {
+		t.Fatalf("expected ErrStateDidNotExisted, got %v", err)
+	}
+}
+
+func TestStateHistory(t *testing.T) {
+	repository := newTestRepository(t)
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	other := &RequestMetadataParams{Repository: repository, Ref: "master", State: "other.json"}
+
+	writer := NewStorageClient()
+	if err := writer.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	for _, content := range []string{"v1", "v2", "v3"} {
+		if err := writer.UpdateState(params, []byte(content)); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+		other.session = params.session
+		if err := writer.UpdateState(other, []byte(content)); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	writer.Disconnect(params)
+
+	// Fresh shallow clone must fetch the history to see all the versions
+	reader := NewStorageClient().(*StorageClient)
+	if err := reader.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer reader.Disconnect(params)
+
+	versions, err := reader.ListStateVersions(params)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+
+	for i, expected := range []string{"v3", "v2", "v1"} {
+		state, err := reader.GetStateVersion(params, versions[i].Revision[:8])
+		if err != nil {
+			t.Fatalf("get version: %v", err)
+		}
+		if string(state) != expected {
+			t.Fatalf("expected %q, got %q", expected, state)
+		}
+	}
+
+	if _, err := reader.GetStateVersion(params, "master~6"); err != types.ErrStateDidNotExisted {
+		t.Fatalf("expected ErrStateDidNotExisted, got %v", err)
+	}
+
+	if _, err := reader.GetStateVersion(params, "0000000000000000000000000000000000000001"); err != types.ErrRevisionNotFound {
+		t.Fatalf("expected ErrRevisionNotFound, got %v", err)
+	}
+
+	// Lock branch commit is there locally, but it is not a version of the state
+	if err := reader.LockState(params, []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	defer reader.UnLockState(params)
+	if _, err := reader.GetStateVersion(params, getLockBranchName(params)); err != types.ErrRevisionNotFound {
+		t.Fatalf("expected ErrRevisionNotFound for the lock branch, got %v", err)
+	}
+}
+
+func TestLockState_ConflictInShallowClone(t *testing.T) {
+	repository := newTestRepository(t)
+
+	first := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	second := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	firstClient := NewStorageClient()
+	if err := firstClient.Connect(first); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer firstClient.Disconnect(first)
+
+	// Shallow clone boundary must have a parent for go-git to run into
+	if err := firstClient.UpdateState(first, []byte("{}")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	secondClient := NewStorageClient()
+	if err := secondClient.Connect(second); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer secondClient.Disconnect(second)
+
+	// Missing object is not a conflict while the remote head is there locally
+	if second.session.rejectedAsNonFastForward("master", plumbing.ErrObjectNotFound) {
+		t.Fatal("expected missing object not to be taken for a conflict")
+	}
+
+	if err := firstClient.LockState(first, []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	if err := secondClient.LockState(second, []byte(`{"ID":"2"}`)); err != types.ErrLockingConflict {
+		t.Fatalf("expected ErrLockingConflict, got %v", err)
+	}
+}
+
+func TestListStateLocks(t *testing.T) {
+	repository := newTestRepository(t)
+
+	first := &RequestMetadataParams{Repository: repository, Ref: "master", State: "env/state.json"}
+	second := &RequestMetadataParams{Repository: repository, Ref: "master", State: "other.json"}
+
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(first); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(first)
+	second.session = first.session
+
+	if err := client.LockState(first, []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := client.LockState(second, []byte(`{"ID":"2"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+
+	// Locks are listed from another clone, so it sees them appear and disappear remotely
+	listParams := &RequestMetadataParams{Repository: repository, Ref: "master", State: "."}
+	lister := NewStorageClient().(*StorageClient)
+	if err := lister.Connect(listParams); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer lister.Disconnect(listParams)
+
+	locks, err := lister.ListStateLocks(listParams)
+	if err != nil {
+		t.Fatalf("list locks: %v", err)
+	}
+	if len(locks) != 2 || string(locks["env/state.json"]) != `{"ID":"1"}` || string(locks["other.json"]) != `{"ID":"2"}` {
+		t.Fatalf("unexpected locks %q", locks)
+	}
+
+	// Released locks must not be listed
+	if err := client.UnLockState(second); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	locks, err = lister.ListStateLocks(listParams)
+	if err != nil {
+		t.Fatalf("list locks: %v", err)
+	}
+	if len(locks) != 1 || string(locks["env/state.json"]) != `{"ID":"1"}` {
+		t.Fatalf("unexpected locks %q", locks)
+	}
+}
+
+// signedCommit updates the state with signing key set, and returns the resulting commit from the remote
+func signedCommit(t *testing.T, key []byte, passphrase string) (string, *object.Commit) {
+	t.Helper()
+
+	keyFile := filepath.Join(t.TempDir(), "signing-key")
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	t.Setenv("GIT_SIGNING_KEY", keyFile)
+	t.Setenv("GIT_SIGNING_KEY_PASSPHRASE", passphrase)
+
+	repository := newTestRepository(t)
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	if err := client.UpdateState(params, []byte("{}")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	head, err := params.session.repository.Reference(ref("master", true), true)
+	if err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	commit, err := params.session.repository.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	return strings.TrimPrefix(repository, "file://"), commit
+}
+
+func TestCommitSigning_OpenPGP(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@localhost", nil)
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	if err := entity.EncryptPrivateKeys([]byte("secret"), nil); err != nil {
+		t.Fatalf("encrypt key: %v", err)
+	}
+
+	var private, public bytes.Buffer
+	w, err := armor.Encode(&private, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor: %v", err)
+	}
+	if err := entity.SerializePrivateWithoutSigning(w, nil); err != nil {
+		t.Fatalf("serialize private: %v", err)
+	}
+	w.Close()
+	w, err = armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("serialize public: %v", err)
+	}
+	w.Close()
+
+	_, commit := signedCommit(t, private.Bytes(), "secret")
+
+	if _, err := commit.Verify(public.String()); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+}
+
+func TestCommitSigning_SSH(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen binary is required to verify SSH signatures")
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("new key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte("secret"))
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+
+	bare, commit := signedCommit(t, pem.EncodeToMemory(block), "secret")
+
+	allowedSigners := filepath.Join(t.TempDir(), "allowed_signers")
+	if err := os.WriteFile(allowedSigners, []byte("* "+string(ssh.MarshalAuthorizedKey(sshPublic))), 0600); err != nil {
+		t.Fatalf("write allowed signers: %v", err)
+	}
+
+	out, err := exec.Command("git", "--git-dir", bare,
+		"-c", "gpg.format=ssh", "-c", "gpg.ssh.allowedSignersFile="+allowedSigners,
+		"verify-commit", commit.Hash.String()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("verify: %v\n%s", err, out)
+	}
+}
+
+func TestCommitTemplates(t *testing.T) {
+	for key, value := range map[string]string{
+		"git.authorName":    "{{.LockInfo.Who}}",
+		"git.authorEmail":   "ci@example.com",
+		"git.committerName": "terraform-backend-git",
+		"git.updateMessage": "{{.Action}} {{.State}} on {{.Ref}}: {{.LockInfo.Operation}} with Terraform {{.LockInfo.Version}} ({{.LockInfo.ID}})",
+	} {
+		viper.Set(key, value)
+		defer viper.Set(key, "")
+	}
+
+	repository := newTestRepository(t)
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	params.SetLockInfo(&types.LockInfo{ID: "1", Who: "alice@laptop", Operation: "OperationTypeApply", Version: "1.5.0"})
+	if err := client.UpdateState(params, []byte("{}")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	head, err := params.session.repository.Reference(ref("master", true), true)
+	if err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	commit, err := params.session.repository.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if commit.Message != "Update state.json on master: OperationTypeApply with Terraform 1.5.0 (1)" {
+		t.Fatalf("unexpected message %q", commit.Message)
+	}
+	if commit.Author.Name != "alice@laptop" || commit.Author.Email != "ci@example.com" {
+		t.Fatalf("unexpected author %s", commit.Author)
+	}
+	if commit.Committer.Name != "terraform-backend-git" || commit.Committer.Email != "ci@example.com" {
+		t.Fatalf("unexpected committer %s", commit.Committer)
+	}
+
+	viper.Set("git.deleteMessage", "{{.Bogus}}")
+	defer viper.Set("git.deleteMessage", "")
+	if err := client.DeleteState(params); err == nil {
+		t.Fatal("expected template error")
+	}
+}
+
+func TestRetryPush_NonFastForward(t *testing.T) {
+	viper.Set("git.pushRetryBackoff", time.Millisecond)
+	defer viper.Set("git.pushRetryBackoff", defaultPushRetryBackoff)
+
+	repository := newTestRepository(t)
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	other := &RequestMetadataParams{Repository: repository, Ref: "master", State: "other.json"}
+
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	// Another backend pushes a change to another state after our pull
+	otherClient := NewStorageClient()
+	if err := otherClient.Connect(other); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if err := otherClient.UpdateState(other, []byte("other")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	otherClient.Disconnect(other)
+
+	if err := params.session.checkout(params.Ref, CheckoutModeDefault); err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+
+	attempts := 0
+	if err := params.session.retryPush(params, func() error {
+		attempts++
+		return params.session.pushState(params, []byte("mine"))
+	}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+
+	reader := NewStorageClient()
+	if err := reader.Connect(other); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer reader.Disconnect(other)
+
+	for state, expected := range map[string]string{"state.json": "mine", "other.json": "other"} {
+		actual, err := reader.GetState(&RequestMetadataParams{Repository: repository, Ref: "master", State: state, session: other.session})
+		if err != nil {
+			t.Fatalf("get %s: %v", state, err)
+		}
+		if string(actual) != expected {
+			t.Fatalf("expected %s to be %q, got %q", state, expected, actual)
+		}
+	}
+
+	// Bounded - it gives up when the remote keeps moving
+	viper.Set("git.pushRetries", 2)
+	defer viper.Set("git.pushRetries", defaultPushRetries)
+
+	attempts = 0
+	if err := params.session.retryPush(params, func() error {
+		attempts++
+		return git.ErrNonFastForwardUpdate
+	}); err != git.ErrNonFastForwardUpdate {
+		t.Fatalf("expected ErrNonFastForwardUpdate, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	// Negative backoff is rejected rather than crashing when the jitter is calculated
+	viper.Set("git.pushRetryBackoff", -time.Millisecond)
+	attempts = 0
+	if err := params.session.retryPush(params, func() error {
+		attempts++
+		return git.ErrNonFastForwardUpdate
+	}); err == nil || err == git.ErrNonFastForwardUpdate {
+		t.Fatalf("expected invalid backoff error, got %v", err)
+	}
+	if attempts != 0 {
+		t.Fatalf("expected no attempts, got %d", attempts)
+	}
+
+	viper.Set("git.pushRetryBackoff", time.Millisecond)
+	viper.Set("git.pushRetries", -1)
+	if err := params.session.retryPush(params, func() error {
+		attempts++
+		return git.ErrNonFastForwardUpdate
+	}); err == nil || err == git.ErrNonFastForwardUpdate {
+		t.Fatalf("expected invalid retries error, got %v", err)
+	}
+	if attempts != 0 {
+		t.Fatalf("expected no attempts, got %d", attempts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	backoff := defaultPushRetryBackoff
+	for attempt, expected := range map[int]time.Duration{1: backoff, 2: 2 * backoff, 3: 4 * backoff, 40: maxPushRetryBackoff, 100: maxPushRetryBackoff} {
+		// Doubling must not overflow no matter how many retries there were
+		if delay := retryDelay(backoff, attempt); delay < expected || delay > expected+backoff {
+			t.Fatalf("attempt %d: expected %s plus jitter, got %s", attempt, expected, delay)
+		}
+	}
+}
+
+// remoteLog lists subjects of commits on master in the test repository, most recent first
+func remoteLog(t *testing.T, repository string) []string {
+	t.Helper()
+
+	out, err := exec.Command("git", "--git-dir", strings.TrimPrefix(repository, "file://"), "log", "--format=%s", "master").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git log: %v\n%s", err, out)
+	}
+
+	return strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+func TestUpdateState_AmendWithLease(t *testing.T) {
+	viper.Set("git.pushRetryBackoff", time.Millisecond)
+	defer viper.Set("git.pushRetryBackoff", defaultPushRetryBackoff)
+
+	repository := newTestRepository(t)
+
+	update := func(state string, amend bool, content string) {
+		t.Helper()
+
+		params := &RequestMetadataParams{Repository: repository, Ref: "master", State: state, Amend: amend}
+		client := NewStorageClient()
+		if err := client.Connect(params); err != nil {
+			t.Fatalf("connect: %v", err)
+		}
+		defer client.Disconnect(params)
+
+		if err := client.UpdateState(params, []byte(content)); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+
+	// Initial commit is not an update of the state, it must stay
+	update("state.json", true, "v1")
+	if log := remoteLog(t, repository); len(log) != 2 || log[0] != "Update state.json" {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	// Fresh shallow clone does not have the parent of the last commit, yet it must be amended
+	update("state.json", true, "v2")
+	if log := remoteLog(t, repository); len(log) != 2 || !strings.HasPrefix(log[0], "Update state.json (amendment of ") {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	// Someone else's commit must not be amended
+	update("other.json", false, "other")
+	update("state.json", true, "v3")
+	if log := remoteLog(t, repository); len(log) != 4 || log[0] != "Update state.json" || log[1] != "Update other.json" {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	// Commit that is not an amend mode update must not be amended, even if it only changed the state
+	update("state.json", false, "theirs")
+	update("state.json", true, "v3")
+	if log := remoteLog(t, repository); len(log) != 6 || log[0] != "Update state.json" || log[1] != "Update state.json" {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	// Committer rendered for this request differs from the last one, i.e. after a restart on another host - still amended
+	viper.Set("git.committerName", "restarted")
+	update("state.json", true, "v3.1")
+	viper.Set("git.committerName", "")
+	if log := remoteLog(t, repository); len(log) != 6 || !strings.HasPrefix(log[0], "Update state.json (amendment of ") {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	// Someone else pushes after our pull - the lease breaks and the update goes on top of their commit
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json", Amend: true}
+	client := NewStorageClient()
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	update("other.json", false, "other2")
+
+	attempts := 0
+	if err := params.session.retryPush(params, func() error {
+		attempts++
+		return params.session.pushState(params, []byte("v4"))
+	}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+	if log := remoteLog(t, repository); len(log) != 8 || log[0] != "Update state.json" || log[1] != "Update other.json" || !strings.HasPrefix(log[2], "Update state.json (amendment of ") {
+		t.Fatalf("unexpected log %q", log)
+	}
+}
+
+func TestCompactStateHistory(t *testing.T) {
+	repository := newTestRepository(t)
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "."}
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	// README.md is not a state, it must keep all of its history
+	for _, update := range []struct{ state, content string }{
+		{"README.md", "r1"},
+		{"state.json", "v1"},
+		{"state.json", "v2"},
+		{"README.md", "r2"},
+		{"dir/other.json", "other"},
+		{"state.json", "v3"},
+		{"state.json", "v4"},
+	} {
+		if err := client.UpdateState(client.ParamsForState(params, update.state), []byte(update.content)); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+
+	// Another backend has the history cached before it was rewritten
+	stale := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	staleClient := NewStorageClient()
+	if err := staleClient.Connect(stale); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer staleClient.Disconnect(stale)
+	if _, err := staleClient.GetState(stale); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	metadata := &types.RequestMetadata{Type: "git", Params: params}
+
+	if _, err := backend.CompactStateHistory(metadata, client, types.CompactionPolicy{Keep: 1}, true); err == nil {
+		t.Fatal("expected error without states to compact")
+	}
+
+	// Only the selected states are compacted
+	plan, err := backend.CompactStateHistory(metadata, client, types.CompactionPolicy{Keep: 1, States: []string{"dir/"}}, true)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan.States) != 0 {
+		t.Fatalf("unexpected plan %+v", plan.States)
+	}
+
+	policy := types.CompactionPolicy{Keep: 2, States: []string{"state.json", "dir/"}}
+
+	plan, err = backend.CompactStateHistory(metadata, client, policy, true)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if len(plan.States) != 1 || plan.States[0] != (types.StateCompaction{State: "state.json", Versions: 4, Kept: 2}) {
+		t.Fatalf("unexpected plan %+v", plan.States)
+	}
+	if log := remoteLog(t, repository); len(log) != 8 {
+		t.Fatalf("dry run must not change the history, got %q", log)
+	}
+
+	// Affected state is locked by someone else
+	locked := &types.RequestMetadata{Type: "git", Params: client.ParamsForState(params, "state.json")}
+	if err := backend.LockState(locked, client, []byte(`{"ID":"someone"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if _, err := backend.CompactStateHistory(metadata, client, policy, false); err == nil {
+		t.Fatal("expected compaction to fail while the state is locked")
+	}
+	if err := client.UnLockState(locked.Params); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+
+	if _, err := backend.CompactStateHistory(metadata, client, policy, false); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+
+	expected := []string{"Update state.json", "Update state.json", "Update dir/other.json", "Update README.md", "Update README.md", "init"}
+	if log := remoteLog(t, repository); strings.Join(log, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected log %q", log)
+	}
+
+	versions, err := client.ListStateVersions(client.ParamsForState(params, "state.json"))
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(versions))
+	}
+	oldest, err := client.GetStateVersion(client.ParamsForState(params, "state.json"), versions[1].Revision)
+	if err != nil {
+		t.Fatalf("get version: %v", err)
+	}
+	if string(oldest) != "v3" {
+		t.Fatalf("expected oldest version to be v3, got %q", oldest)
+	}
+
+	// Nothing left to compact
+	plan, err = backend.CompactStateHistory(metadata, client, policy, false)
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if len(plan.States) != 0 {
+		t.Fatalf("unexpected plan %+v", plan.States)
+	}
+
+	// Backend with the old history picks up the rewritten one
+	if err := staleClient.UpdateState(stale, []byte("v5")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if log := remoteLog(t, repository); len(log) != 7 || log[0] != "Update state.json" {
+		t.Fatalf("unexpected log %q", log)
+	}
+}
+
+// lfsTestServer is a minimal LFS server keeping objects in memory
+type lfsTestServer struct {
+	*httptest.Server
+
+	objects map[string][]byte
+	uploads int
+}
+
+func newLFSTestServer(t *testing.T, username, password string) *lfsTestServer {
+	t.Helper()
+
+	server := &lfsTestServer{objects: make(map[string][]byte)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		oid := strings.TrimPrefix(r.URL.Path, "/objects/")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/objects/batch":
+			var batch lfsBatchRequest
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			response := lfsBatchResponse{Transfer: "basic"}
+			for _, object := range batch.Objects {
+				_, exists := server.objects[object.OID]
+				action := lfsAction{Href: server.URL + "/objects/" + object.OID, Header: map[string]string{"Authorization": r.Header.Get("Authorization")}}
+				switch {
+				case batch.Operation == "upload" && !exists:
+					object.Actions = map[string]lfsAction{"upload": action}
+				case batch.Operation == "download" && exists:
+					object.Actions = map[string]lfsAction{"download": action}
+				case batch.Operation == "download":
+					object.Error = &lfsError{Code: http.StatusNotFound, Message: "Object does not exist"}
+				}
+				response.Objects = append(response.Objects, object)
+			}
+
+			w.Header().Set("Content-Type", lfsMediaType)
+			json.NewEncoder(w).Encode(response)
+		case r.Method == http.MethodPut:
+			content, _ := ioutil.ReadAll(r.Body)
+			server.objects[oid] = content
+			server.uploads++
+		case r.Method == http.MethodGet:
+			w.Write(server.objects[oid])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestLFSClient_Timeout(t *testing.T) {
+	// Server that does not respond until the test is over
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	viper.Set("git.lfsURL", server.URL)
+	defer viper.Set("git.lfsURL", "")
+	viper.Set("git.lfsTimeout", 100*time.Millisecond)
+	defer viper.Set("git.lfsTimeout", defaultLFSTimeout)
+
+	client, err := newLFSClient("https://github.com/org/repo.git", &githttp.BasicAuth{Username: "lfs", Password: "secret"})
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.upload([]byte("state"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected upload to time out")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload to unresponsive LFS server did not time out")
+	}
+
+	viper.Set("git.lfsTimeout", 0)
+	if _, err := newLFSClient("https://github.com/org/repo.git", nil); err == nil || !strings.Contains(err.Error(), "git.lfsTimeout") {
+		t.Fatalf("expected error for zero git.lfsTimeout, got %v", err)
+	}
+}
+
+func TestUpdateState_LFS(t *testing.T) {
+	t.Setenv("GIT_USERNAME", "lfs")
+	t.Setenv("GIT_PASSWORD", "secret")
+	server := newLFSTestServer(t, "lfs", "secret")
+
+	repository := newTestRepository(t)
+
+	viper.Set("git.lfsURL", server.URL)
+	defer viper.Set("git.lfsURL", "")
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	// Stored before LFS was enabled
+	if err := client.UpdateState(params, []byte("plain")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	viper.Set("git.lfs", true)
+	defer viper.Set("git.lfs", false)
+
+	// Objects server already has are not uploaded again
+	state := bytes.Repeat([]byte("large "), 1000)
+	for _, content := range [][]byte{state, []byte("other"), state} {
+		if err := client.UpdateState(params, content); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if server.uploads != 2 {
+		t.Fatalf("expected 2 uploads, got %d", server.uploads)
+	}
+
+	out, err := exec.Command("git", "--git-dir", strings.TrimPrefix(repository, "file://"), "show", "master:state.json").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git show: %v\n%s", err, out)
+	}
+	if pointer := parseLFSPointer(out); pointer == nil || *pointer != *newLFSPointer(state) {
+		t.Fatalf("expected LFS pointer in the repository, got %q", out)
+	}
+
+	// State is tracked by LFS once, no matter how many times it was updated
+	out, err = exec.Command("git", "--git-dir", strings.TrimPrefix(repository, "file://"), "show", "master:.gitattributes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git show: %v\n%s", err, out)
+	}
+	if string(out) != "state.json filter=lfs diff=lfs merge=lfs -text\n" {
+		t.Fatalf("unexpected .gitattributes %q", out)
+	}
+
+	// Existing attributes are kept
+	other := client.ParamsForState(params, "my state.json").(*RequestMetadataParams)
+	if err := client.UpdateState(other, []byte("other")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	out, err = exec.Command("git", "--git-dir", strings.TrimPrefix(repository, "file://"), "show", "master:.gitattributes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("git show: %v\n%s", err, out)
+	}
+	if string(out) != "state.json filter=lfs diff=lfs merge=lfs -text\nmy[[:space:]]state.json filter=lfs diff=lfs merge=lfs -text\n" {
+		t.Fatalf("unexpected .gitattributes %q", out)
+	}
+
+	actual, err := client.GetState(params)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !bytes.Equal(actual, state) {
+		t.Fatalf("expected state to be resolved from LFS, got %q", actual)
+	}
+
+	versions, err := client.ListStateVersions(params)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	for i, expected := range [][]byte{state, []byte("other"), state, []byte("plain")} {
+		actual, err := client.GetStateVersion(params, versions[i].Revision)
+		if err != nil {
+			t.Fatalf("get version: %v", err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Fatalf("unexpected version %d: %q", i, actual)
+		}
+	}
+
+	// Object is gone from the server
+	server.objects = make(map[string][]byte)
+	if _, err := client.GetState(params); err == nil || !strings.Contains(err.Error(), "Object does not exist") {
+		t.Fatalf("expected missing object error, got %v", err)
+	}
+}
+
+func writeTestClientCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write certificate: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+func TestRepositoryHTTPSOptions(t *testing.T) {
+	dir := t.TempDir()
+	clientCert := writeTestClientCert(t, dir)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caBundle := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatalf("write CA bundle: %v", err)
+	}
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	viper.Set("git.proxy", proxy.URL)
+	defer viper.Set("git.proxy", "")
+	viper.Set("git.credentials", []map[string]interface{}{
+		{"repository": "https://git.my-org.com/*", "caBundle": caBundle, "clientCert": filepath.Join(dir, "client.crt"), "clientKey": filepath.Join(dir, "client.key")},
+		{"repository": "https://broken.my-org.com/*", "clientCert": filepath.Join(dir, "client.crt")},
+	})
+	defer viper.Set("git.credentials", nil)
+
+	get := func(repository, url string) {
+		t.Helper()
+		options, err := repositoryHTTPSOptions(url, repository)
+		if err != nil {
+			t.Fatalf("repositoryHTTPSOptions: %v", err)
+		}
+		client, err := options.httpClient()
+		if err != nil {
+			t.Fatalf("httpClient: %v", err)
+		}
+		response, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("get %s: %v", url, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusNoContent {
+			t.Fatalf("get %s: unexpected status %d", url, response.StatusCode)
+		}
+	}
+
+	// Private CA and client certificate from the entry, loopback is never proxied
+	get("https://git.my-org.com/org/repo.git", server.URL)
+
+	// Global proxy for other repositories
+	get("https://github.com/org/repo.git", "http://example.invalid/org/repo.git/info/lfs")
+	if proxied != "http://example.invalid/org/repo.git/info/lfs" {
+		t.Fatalf("expected request through the proxy, got %q", proxied)
+	}
+
+	// Entry without credentials leaves them to the environment
+	t.Setenv("GIT_USERNAME", "env")
+	t.Setenv("GIT_PASSWORD", "env")
+	auth, err := auth(&RequestMetadataParams{Repository: "https://git.my-org.com/org/repo.git"})
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	if auth.(*githttp.BasicAuth).Username != "env" {
+		t.Fatalf("expected credentials from the environment, got %v", auth)
+	}
+
+	// Not applied to SSH, as go-git would use the proxy for it too
+	if options, err := remoteHTTPSOptions("git@github.com:org/repo.git"); err != nil || options.proxy.URL != "" {
+		t.Fatalf("expected no HTTPS options for SSH, got %+v, %v", options, err)
+	}
+
+	if _, err := remoteHTTPSOptions("https://broken.my-org.com/org/repo.git"); err == nil || !strings.Contains(err.Error(), "Both client certificate and key") {
+		t.Fatalf("expected an error for client certificate without key, got %v", err)
+	}
+}
+
+func TestLFSEndpoint(t *testing.T) {
+	for remote, expected := range map[string]string{
+		"https://github.com/my-org/tf-state":              "https://github.com/my-org/tf-state.git/info/lfs",
+		"https://user@git.local:8443/my-org/tf-state.git": "https://git.local:8443/my-org/tf-state.git/info/lfs",
+		"git@github.com:my-org/tf-state.git":              "https://github.com/my-org/tf-state.git/info/lfs",
+		"ssh://git@github.com/my-org/tf-state":            "https://github.com/my-org/tf-state.git/info/lfs",
+	} {
+		actual, err := lfsEndpoint(remote)
+		if err != nil {
+			t.Fatalf("%s: %v", remote, err)
+		}
+		if actual != expected {
+			t.Fatalf("%s: expected %s, got %s", remote, expected, actual)
+		}
+	}
+
+	if _, err := lfsEndpoint("file:///tmp/repo.git"); err == nil {
+		t.Fatal("expected error for file remote")
+	}
+}
+
+// remoteRef resolves the ref in the test repository, or returns an empty string if it didn't exist
+func remoteRef(t *testing.T, repository, ref string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", "--git-dir", strings.TrimPrefix(repository, "file://"), "rev-parse", "--verify", "--quiet", ref).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func TestIsRejectedPack(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"unpack error: unpack-objects abnormal exit":                         true,
+		"command error on refs/heads/master: missing necessary objects":      true,
+		"command error on refs/heads/master: shallow update not allowed":     true,
+		"command error on refs/heads/master: pre-receive hook declined":      false,
+		"command error on refs/heads/master: protected branch hook declined": false,
+		"non-fast-forward update: refs/heads/master":                         false,
+	} {
+		if actual := isRejectedPack(errors.New(msg)); actual != expected {
+			t.Fatalf("%q: expected %t, got %t", msg, expected, actual)
+		}
+	}
+
+	if isRejectedPack(nil) {
+		t.Fatal("expected nil not to be a rejected pack")
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	repository := newTestRepository(t)
+	mirror := newTestRepository(t)
+
+	viper.Set("git.mirrors", []string{mirror})
+	defer viper.Set("git.mirrors", nil)
+	viper.Set("git.mirrorLocks", true)
+	defer viper.Set("git.mirrorLocks", false)
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	if err := client.LockState(params, []byte(`{"ID":"1"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if remoteRef(t, mirror, "locks/state.json") == "" {
+		t.Fatal("expected lock to be mirrored")
+	}
+
+	if err := client.UpdateState(params, []byte("v1")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if expected, actual := remoteRef(t, repository, "master"), remoteRef(t, mirror, "master"); actual != expected {
+		t.Fatalf("expected mirror at %s, got %s", expected, actual)
+	}
+
+	if err := client.UnLockState(params); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if remoteRef(t, mirror, "locks/state.json") != "" {
+		t.Fatal("expected lock to be released on the mirror")
+	}
+
+	// Mirror added later is behind beyond the shallow clone, it gets complete history
+	late := newTestRepository(t)
+	viper.Set("git.mirrors", []string{mirror, late})
+	if err := client.UpdateState(params, []byte("v2")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	for _, m := range []string{mirror, late} {
+		if expected, actual := remoteRef(t, repository, "master"), remoteRef(t, m, "master"); actual != expected {
+			t.Fatalf("expected mirror %s at %s, got %s", m, expected, actual)
+		}
+	}
+
+	// Broken mirror is only logged by default
+	broken := "file://" + filepath.ToSlash(filepath.Join(t.TempDir(), "missing.git"))
+	viper.Set("git.mirrors", []string{broken})
+	if err := client.UpdateState(params, []byte("v3")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Fatal policy refuses the request before the main repository has it
+	viper.Set("git.mirrorPolicy", mirrorPolicyFatal)
+	defer viper.Set("git.mirrorPolicy", mirrorPolicyLog)
+	head := remoteRef(t, repository, "master")
+	if err := client.UpdateState(params, []byte("v4")); err == nil {
+		t.Fatal("expected update to fail with fatal mirror policy")
+	}
+	if err := client.DeleteState(params); err == nil {
+		t.Fatal("expected delete to fail with fatal mirror policy")
+	}
+	if actual := remoteRef(t, repository, "master"); actual != head {
+		t.Fatalf("expected master to stay at %s, got %s", head, actual)
+	}
+	if err := client.LockState(params, []byte(`{"ID":"2"}`)); err == nil {
+		t.Fatal("expected lock to fail with fatal mirror policy")
+	}
+	if remoteRef(t, repository, "locks/state.json") != "" {
+		t.Fatal("expected no lock when it could not be mirrored")
+	}
+
+	// Empty mirror can be reached, it's just that nothing was pushed to it yet
+	empty := "file://" + filepath.ToSlash(t.TempDir())
+	if err := exec.Command("git", "init", "--bare", strings.TrimPrefix(empty, "file://")).Run(); err != nil {
+		t.Fatalf("git init: %v", err)
+	}
+	viper.Set("git.mirrors", []string{empty})
+	if err := client.UpdateState(params, []byte("v4")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if expected, actual := remoteRef(t, repository, "master"), remoteRef(t, empty, "master"); actual != expected {
+		t.Fatalf("expected empty mirror at %s, got %s", expected, actual)
+	}
+
+	// Sync brings the mirror up to date, including locks
+	other := &RequestMetadataParams{Repository: repository, Ref: "master", State: "other.json", session: params.session}
+	viper.Set("git.mirrors", nil)
+	if err := client.LockState(other, []byte(`{"ID":"3"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	viper.Set("git.mirrors", []string{"{{.Repository}}.mirror"})
+	if _, err := client.SyncMirrors(params); err == nil {
+		t.Fatal("expected sync to fail for missing mirror")
+	}
+
+	viper.Set("git.mirrors", []string{mirror})
+	if err := exec.Command("git", "--git-dir", strings.TrimPrefix(mirror, "file://"), "update-ref", "refs/heads/locks/stale.json", remoteRef(t, mirror, "master")).Run(); err != nil {
+		t.Fatalf("update-ref: %v", err)
+	}
+	synced, err := client.SyncMirrors(params)
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(synced) != 1 || synced[0] != mirror {
+		t.Fatalf("unexpected synced mirrors %q", synced)
+	}
+	for _, ref := range []string{"master", "locks/other.json"} {
+		if expected, actual := remoteRef(t, repository, ref), remoteRef(t, mirror, ref); actual != expected {
+			t.Fatalf("expected mirror %s at %s, got %s", ref, expected, actual)
+		}
+	}
+	if remoteRef(t, mirror, "locks/stale.json") != "" {
+		t.Fatal("expected stale lock to be pruned on the mirror")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	var received []types.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(payload)
+		if r.Header.Get("X-Terraform-Backend-Git-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("unexpected signature %q", r.Header.Get("X-Terraform-Backend-Git-Signature"))
+		}
+
+		var event types.Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			t.Errorf("unexpected payload %s: %v", payload, err)
+		}
+		if r.Header.Get("X-Terraform-Backend-Git-Event") != event.Event {
+			t.Errorf("unexpected event header %q", r.Header.Get("X-Terraform-Backend-Git-Event"))
+		}
+		received = append(received, event)
+	}))
+	defer server.Close()
+
+	viper.Set("webhooks", []string{server.URL})
+	defer viper.Set("webhooks", nil)
+	viper.Set("webhookSecret", "s3cret")
+	defer viper.Set("webhookSecret", "")
+
+	repository := newTestRepository(t)
+
+	params := &RequestMetadataParams{Repository: repository, Ref: "master", State: "state.json"}
+	client := NewStorageClient().(*StorageClient)
+	if err := client.Connect(params); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer client.Disconnect(params)
+
+	// Each step waits for the events, so they are received in order
+	metadata := &types.RequestMetadata{Type: "git", Params: params}
+	other := &types.RequestMetadata{Type: "git", Params: client.ParamsForState(params, "state.json")}
+	for _, step := range []func() error{
+		func() error { return backend.LockState(metadata, client, []byte(`{"ID":"1","Who":"me"}`)) },
+		func() error {
+			if err := backend.LockState(other, client, []byte(`{"ID":"2","Who":"someone"}`)); err == nil {
+				t.Fatal("expected lock conflict")
+			}
+			return nil
+		},
+		func() error {
+			metadata.ID = "1"
+			return backend.UpdateState(metadata, client, []byte(`{"serial":1}`))
+		},
+		func() error { return backend.DeleteState(metadata, client) },
+		func() error { return backend.UnLockState(metadata, client, []byte(`{"ID":"1"}`)) },
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", len(received), err)
+		}
+		backend.WaitForNotifications()
+	}
+
+	expected := []struct {
+		event, lockID, conflictingLockID string
+		revision                         bool
+	}{
+		{types.EventLockAcquired, "1", "", true},
+		{types.EventLockConflict, "2", "1", false},
+		{types.EventStateUpdated, "1", "", true},
+		{types.EventStateDeleted, "1", "", true},
+		{types.EventLockReleased, "1", "", false},
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), received)
+	}
+	for i, e := range expected {
+		event := received[i]
+		if event.Event != e.event || event.Type != "git" || event.Repository != repository || event.Ref != "master" || event.State != "state.json" {
+			t.Fatalf("unexpected event %d: %+v", i, event)
+		}
+		if event.LockInfo == nil || event.LockInfo.ID != e.lockID {
+			t.Fatalf("unexpected lock in event %d: %+v", i, event.LockInfo)
+		}
+		if (e.conflictingLockID == "" && event.ConflictingLockInfo != nil) ||
+			(e.conflictingLockID != "" && (event.ConflictingLockInfo == nil || event.ConflictingLockInfo.ID != e.conflictingLockID)) {
+			t.Fatalf("unexpected conflicting lock in event %d: %+v", i, event.ConflictingLockInfo)
+		}
+		if (event.Revision != "") != e.revision {
+			t.Fatalf("unexpected revision in event %d: %q", i, event.Revision)
+		}
+	}
+	if received[3].Revision != remoteRef(t, repository, "master") {
+		t.Fatalf("expected revision of the delete commit, got %s", received[3].Revision)
+	}
+
+	// Only subscribed events are sent
+	viper.Set("webhookEvents", []string{types.EventStateUpdated})
+	defer viper.Set("webhookEvents", nil)
+	metadata.ID = ""
+	if err := backend.LockState(metadata, client, []byte(`{"ID":"3"}`)); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	backend.WaitForNotifications()
+	if len(received) != len(expected) {
+		t.Fatalf("expected no more events, got %+v", received[len(expected):])
+	}
+}
@@ -0,0 +1,138 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// ListStateVersions lists commits on Ref that touched the state file, most recent first.
+// Complete history of Ref will be fetched for that, so the session will no longer be a shallow clone.
+func (storageClient *StorageClient) ListStateVersions(p types.RequestMetadataParams) ([]types.StateVersion, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	if err := storageSession.fetchHistory(params.Ref); err != nil {
+		return nil, err
+	}
+
+	head, err := storageSession.repository.Reference(ref(params.Ref, true), true)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := storageSession.repository.Log(&git.LogOptions{
+		From:     head.Hash(),
+		FileName: &params.State,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer commits.Close()
+
+	versions := make([]types.StateVersion, 0)
+	if err := commits.ForEach(func(commit *object.Commit) error {
+		versions = append(versions, types.StateVersion{
+			Revision: commit.Hash.String(),
+			Author:   fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+			Time:     commit.Author.When,
+			Message:  commit.Message,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// GetStateVersion reads the state file as it was at the given commit.
+// Revision can be anything go-git can resolve, i.e. full or abbreviated commit hash, as long as it is in the history of Ref.
+// If it was stored in LFS, the content is downloaded.
+func (storageClient *StorageClient) GetStateVersion(p types.RequestMetadataParams, revision string) ([]byte, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	if err := storageSession.fetchHistory(params.Ref); err != nil {
+		return nil, err
+	}
+
+	commit, err := storageSession.commitAt(params.Ref, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := storageSession.readFileAt(commit, params.State)
+	if err != nil {
+		return nil, err
+	}
+
+	return storageSession.lfsResolve(state)
+}
+
+// commitAt resolves the revision to a commit in the history of the branch.
+// Returns ErrRevisionNotFound if it can't be resolved, or resolves to something other branches or tags point to.
+func (storageSession *storageSession) commitAt(branch, revision string) (*object.Commit, error) {
+	hash, err := storageSession.repository.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		if err == plumbing.ErrReferenceNotFound {
+			return nil, types.ErrRevisionNotFound
+		}
+		return nil, err
+	}
+
+	commit, err := storageSession.repository.CommitObject(*hash)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			return nil, types.ErrRevisionNotFound
+		}
+		return nil, err
+	}
+
+	head, err := storageSession.repository.Reference(ref(branch, true), true)
+	if err != nil {
+		return nil, err
+	}
+
+	headCommit, err := storageSession.repository.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	onBranch, err := commit.IsAncestor(headCommit)
+	if err != nil {
+		return nil, err
+	}
+	if !onBranch {
+		return nil, types.ErrRevisionNotFound
+	}
+
+	return commit, nil
+}
+
+// readFileAt reads a file as it was at the given commit.
+// Returns ErrStateDidNotExisted if file didn't exist at that commit.
+func (storageSession *storageSession) readFileAt(commit *object.Commit, path string) ([]byte, error) {
+	file, err := commit.File(path)
+	if err != nil {
+		if err == object.ErrFileNotFound {
+			return nil, types.ErrStateDidNotExisted
+		}
+		return nil, err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
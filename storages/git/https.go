@@ -0,0 +1,156 @@
+package git
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// httpsOptions are TLS and proxy settings for Git operations over HTTPS and requests to the LFS server
+type httpsOptions struct {
+	// caBundle is PEM certificates to trust in addition to the system ones
+	caBundle []byte
+
+	// clientCert and clientKey is the PEM key pair for mutual TLS
+	clientCert, clientKey []byte
+
+	// proxy is used instead of the one from HTTPS_PROXY/HTTP_PROXY environment variables, unless the host is in NO_PROXY
+	proxy transport.ProxyOptions
+}
+
+// readHTTPSFile reads a file set in HTTPS options
+func readHTTPSFile(file string) ([]byte, error) {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(file)
+}
+
+// repositoryHTTPSOptions reads HTTPS options for requests to the target URL on behalf of the repository, i.e. to its LFS server.
+// Settings from the git.credentials entry matching any of the repository URLs take precedence over global ones.
+// Files are read every time, so renewed certificates are picked up without restarting the backend.
+func repositoryHTTPSOptions(target string, repositories ...string) (*httpsOptions, error) {
+	entry, err := repositoryCredentials(repositories...)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = &credentialsEntry{}
+	}
+
+	setting := func(value, key string) string {
+		if value != "" {
+			return value
+		}
+		return viper.GetString(key)
+	}
+
+	options := &httpsOptions{}
+
+	if caBundle := setting(entry.CABundle, "git.caBundle"); caBundle != "" {
+		options.caBundle, err = readHTTPSFile(caBundle)
+		if err != nil {
+			return nil, err
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(options.caBundle) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", caBundle)
+		}
+	}
+
+	clientCert, clientKey := setting(entry.ClientCert, "git.clientCert"), setting(entry.ClientKey, "git.clientKey")
+	if (clientCert == "") != (clientKey == "") {
+		return nil, fmt.Errorf("Both client certificate and key must be set for %s", target)
+	}
+	if clientCert != "" {
+		options.clientCert, err = readHTTPSFile(clientCert)
+		if err != nil {
+			return nil, err
+		}
+		options.clientKey, err = readHTTPSFile(clientKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tls.X509KeyPair(options.clientCert, options.clientKey); err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate %s: %w", clientCert, err)
+		}
+	}
+
+	if proxy := setting(entry.Proxy, "git.proxy"); proxy != "" {
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+
+		// Same as with HTTPS_PROXY, hosts in NO_PROXY are connected to directly
+		config := httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy, NoProxy: httpproxy.FromEnvironment().NoProxy}
+		proxyURL, err := config.ProxyFunc()(targetURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL for %s: %w", target, err)
+		}
+		if proxyURL != nil {
+			options.proxy = transport.ProxyOptions{URL: proxyURL.String()}
+		}
+	}
+
+	return options, nil
+}
+
+// remoteHTTPSOptions reads HTTPS options for Git operations on the remote, repositories are the URLs it was resolved from.
+// Options are empty for remotes that are not HTTP, as go-git would use the proxy for SSH as well.
+func remoteHTTPSOptions(remoteURL string, repositories ...string) (*httpsOptions, error) {
+	if !strings.HasPrefix(remoteURL, "http") {
+		return &httpsOptions{}, nil
+	}
+
+	return repositoryHTTPSOptions(remoteURL, append(repositories, remoteURL)...)
+}
+
+// httpClient makes a new client with these options, the same way go-git does it for Git operations
+func (options *httpsOptions) httpClient() (*http.Client, error) {
+	if len(options.caBundle) == 0 && len(options.clientCert) == 0 && options.proxy.URL == "" {
+		return &http.Client{}, nil
+	}
+
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if httpTransport.TLSClientConfig == nil {
+		httpTransport.TLSClientConfig = &tls.Config{}
+	}
+
+	if len(options.caBundle) > 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		rootCAs.AppendCertsFromPEM(options.caBundle)
+		httpTransport.TLSClientConfig.RootCAs = rootCAs
+	}
+
+	if len(options.clientCert) > 0 {
+		keyPair, err := tls.X509KeyPair(options.clientCert, options.clientKey)
+		if err != nil {
+			return nil, err
+		}
+		httpTransport.TLSClientConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	if options.proxy.URL != "" {
+		proxyURL, err := options.proxy.FullURL()
+		if err != nil {
+			return nil, err
+		}
+		httpTransport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: httpTransport}, nil
+}
@@ -0,0 +1,220 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	sshGit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/skeema/knownhosts"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// Same values as StrictHostKeyChecking in ssh_config
+const (
+	// hostKeyCheckingYes only accepts host keys that are pinned or in known_hosts
+	hostKeyCheckingYes = "yes"
+
+	// hostKeyCheckingAcceptNew records keys of hosts not yet in known_hosts, but still rejects changed keys
+	hostKeyCheckingAcceptNew = "accept-new"
+
+	// hostKeyCheckingNo accepts any host key, only left for backward compatibility
+	hostKeyCheckingNo = "no"
+)
+
+// knownHostsMutex serializes writes to known_hosts files
+var knownHostsMutex sync.Mutex
+
+// hostKeyChecking tells how to check host keys, git.strictHostKeyChecking takes precedence over legacy StrictHostKeyChecking env variable
+func hostKeyChecking() (string, error) {
+	mode := viper.GetString("git.strictHostKeyChecking")
+	if mode == "" {
+		return legacyHostKeyChecking(), nil
+	}
+
+	switch mode {
+	case hostKeyCheckingYes, hostKeyCheckingAcceptNew, hostKeyCheckingNo:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("Unknown git.strictHostKeyChecking %q, expected %s, %s or %s", mode, hostKeyCheckingYes, hostKeyCheckingAcceptNew, hostKeyCheckingNo)
+	}
+}
+
+// legacyHostKeyChecking reads StrictHostKeyChecking env variable.
+// It used to only be checked for "no", so any other value it might have been set to in existing setups must keep working.
+func legacyHostKeyChecking() string {
+	switch mode := os.Getenv("StrictHostKeyChecking"); mode {
+	case "":
+		return hostKeyCheckingYes
+	case hostKeyCheckingYes, hostKeyCheckingAcceptNew, hostKeyCheckingNo:
+		return mode
+	default:
+		log.Printf("WARNING: Unknown StrictHostKeyChecking %q, checking host keys as with %s", mode, hostKeyCheckingYes)
+		return hostKeyCheckingYes
+	}
+}
+
+// knownHostsFiles lists git.knownHosts, or the same files go-git would use by default.
+// New host keys are recorded to the first one.
+func knownHostsFiles() ([]string, error) {
+	if files := viper.GetStringSlice("git.knownHosts"); len(files) > 0 {
+		return files, nil
+	}
+
+	if files := filepath.SplitList(os.Getenv("SSH_KNOWN_HOSTS")); len(files) > 0 {
+		return files, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		filepath.Join(home, ".ssh", "known_hosts"),
+		"/etc/ssh/ssh_known_hosts",
+	}, nil
+}
+
+// pinnedFingerprints returns fingerprints from git.hostKeyFingerprints pinned for the host.
+// Each entry is host=fingerprint, where host is as in known_hosts, i.e. [host]:port for non-default ports,
+// and fingerprint is SHA256 as printed by ssh-keygen -l.
+func pinnedFingerprints(hostWithPort string) ([]string, error) {
+	host := knownhosts.Normalize(hostWithPort)
+
+	var fingerprints []string
+	for _, entry := range viper.GetStringSlice("git.hostKeyFingerprints") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[1], "SHA256:") {
+			return nil, fmt.Errorf("Invalid git.hostKeyFingerprints entry %q, expected host=SHA256:fingerprint", entry)
+		}
+
+		if knownhosts.Normalize(kv[0]) == host {
+			fingerprints = append(fingerprints, strings.TrimRight(kv[1], "="))
+		}
+	}
+
+	return fingerprints, nil
+}
+
+// pinnedHostKeyCallback only accepts host keys with one of the fingerprints
+func pinnedHostKeyCallback(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range fingerprints {
+			if fingerprint == pinned {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%s host key %s of %s is not pinned in git.hostKeyFingerprints", key.Type(), fingerprint, hostname)
+	}
+}
+
+// knownHostsCallback checks host keys against known_hosts files.
+// With acceptNew, keys of hosts that are not there yet are recorded to the first file.
+func knownHostsCallback(files []string, acceptNew bool) (*knownhosts.HostKeyDB, ssh.HostKeyCallback, error) {
+	existing := make([]string, 0, len(files))
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		} else if !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+
+	if len(existing) == 0 && !acceptNew {
+		return nil, nil, fmt.Errorf("None of known_hosts files %s exist, set git.knownHosts or git.hostKeyFingerprints", strings.Join(files, ", "))
+	}
+
+	db, err := knownhosts.NewDB(existing...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	callback := db.HostKeyCallback()
+	if !acceptNew {
+		return db, callback, nil
+	}
+
+	return db, func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if !knownhosts.IsHostUnknown(err) {
+			return err
+		}
+
+		if err := recordKnownHost(files[0], hostname, remote, key); err != nil {
+			return fmt.Errorf("Failed to record host key of %s: %w", hostname, err)
+		}
+		log.Printf("Permanently added %s host key %s of %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, files[0])
+
+		return nil
+	}, nil
+}
+
+// recordKnownHost appends the host key to the known_hosts file, creating it if needed
+func recordKnownHost(file, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMutex.Lock()
+	defer knownHostsMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := knownhosts.WriteKnownHost(f, hostname, remote, key); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// hostKeyCallbackHelper builds host key verification for the SSH endpoint.
+// Fingerprints pinned for the host take precedence over known_hosts, that are not consulted for it at all.
+func hostKeyCallbackHelper(e *transport.Endpoint) (sshGit.HostKeyCallbackHelper, error) {
+	mode, err := hostKeyChecking()
+	if err != nil {
+		return sshGit.HostKeyCallbackHelper{}, err
+	}
+
+	if mode == hostKeyCheckingNo {
+		return sshGit.HostKeyCallbackHelper{HostKeyCallback: ssh.InsecureIgnoreHostKey()}, nil
+	}
+
+	hostWithPort := sshHostWithPort(e)
+
+	fingerprints, err := pinnedFingerprints(hostWithPort)
+	if err != nil {
+		return sshGit.HostKeyCallbackHelper{}, err
+	}
+	if len(fingerprints) > 0 {
+		return sshGit.HostKeyCallbackHelper{HostKeyCallback: pinnedHostKeyCallback(fingerprints)}, nil
+	}
+
+	files, err := knownHostsFiles()
+	if err != nil {
+		return sshGit.HostKeyCallbackHelper{}, err
+	}
+
+	db, callback, err := knownHostsCallback(files, mode == hostKeyCheckingAcceptNew)
+	if err != nil {
+		return sshGit.HostKeyCallbackHelper{}, err
+	}
+
+	// Offer key types that are known for the host first, otherwise it might present another key that we don't know
+	return sshGit.HostKeyCallbackHelper{
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: db.HostKeyAlgorithms(hostWithPort),
+	}, nil
+}
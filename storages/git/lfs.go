@@ -0,0 +1,457 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/spf13/viper"
+)
+
+// See https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md and https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+const (
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	lfsMediaType      = "application/vnd.git-lfs+json"
+
+	// lfsMaxPointerSize is how big a pointer file can be, anything bigger is a regular file
+	lfsMaxPointerSize = 1024
+
+	// lfsAttributesPath is where git-lfs expects to find what files are tracked
+	lfsAttributesPath = ".gitattributes"
+
+	// lfsAttributes are the attributes git lfs track sets on tracked files
+	lfsAttributes = "filter=lfs diff=lfs merge=lfs -text"
+
+	// defaultLFSTimeout is how long a request to the LFS server may take unless git.lfsTimeout says otherwise
+	defaultLFSTimeout = 5 * time.Minute
+)
+
+func init() {
+	viper.SetDefault("git.lfsTimeout", defaultLFSTimeout)
+}
+
+// lfsPointer is what is stored in the repository in place of the file content
+type lfsPointer struct {
+	// OID is the SHA-256 of the content, hex encoded
+	OID  string
+	Size int64
+}
+
+// newLFSPointer makes a pointer to this content
+func newLFSPointer(content []byte) *lfsPointer {
+	hash := sha256.Sum256(content)
+	return &lfsPointer{
+		OID:  hex.EncodeToString(hash[:]),
+		Size: int64(len(content)),
+	}
+}
+
+// parseLFSPointer returns the pointer if content was one, or nil if it is a regular file
+func parseLFSPointer(content []byte) *lfsPointer {
+	if len(content) > lfsMaxPointerSize || !bytes.HasPrefix(content, []byte("version "+lfsPointerVersion+"\n")) {
+		return nil
+	}
+
+	pointer := &lfsPointer{Size: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value := scanner.Text(), ""
+		if i := strings.IndexByte(key, ' '); i >= 0 {
+			key, value = key[:i], key[i+1:]
+		}
+
+		switch key {
+		case "oid":
+			pointer.OID = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil
+			}
+			pointer.Size = size
+		}
+	}
+
+	if len(pointer.OID) != sha256.Size*2 || pointer.Size < 0 {
+		return nil
+	}
+
+	return pointer
+}
+
+// Bytes is the pointer file content
+func (pointer *lfsPointer) Bytes() []byte {
+	return []byte(fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, pointer.OID, pointer.Size))
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+	HashAlgo  string      `json:"hash_algo"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string      `json:"transfer"`
+	Objects  []lfsObject `json:"objects"`
+}
+
+type lfsObject struct {
+	OID     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *lfsError            `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// lfsClient talks to the LFS server of the remote repository using the basic transfer adapter
+type lfsClient struct {
+	endpoint string
+	auth     *githttp.BasicAuth
+	client   *http.Client
+}
+
+// lfsEndpoint derives LFS server URL from the remote URL, unless git.lfsURL says otherwise.
+// As git-lfs does, for SSH remotes it assumes the server is available over HTTPS on the same host.
+func lfsEndpoint(remoteURL string) (string, error) {
+	if endpoint := viper.GetString("git.lfsURL"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/"), nil
+	}
+
+	e, err := transport.NewEndpoint(remoteURL)
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{Host: e.Host}
+	switch e.Protocol {
+	case "http", "https":
+		u.Scheme = e.Protocol
+		if e.Port != 0 {
+			u.Host = fmt.Sprintf("%s:%d", e.Host, e.Port)
+		}
+	case "ssh":
+		u.Scheme = "https"
+		host, _, err := net.SplitHostPort(sshHostWithPort(e))
+		if err != nil {
+			return "", err
+		}
+		u.Host = host
+	default:
+		return "", fmt.Errorf("LFS server URL can't be derived from %s, please set git.lfsURL", remoteURL)
+	}
+
+	path := strings.TrimSuffix(e.Path, "/")
+	if !strings.HasSuffix(path, ".git") {
+		path += ".git"
+	}
+	u.Path = "/" + strings.TrimPrefix(path, "/") + "/info/lfs"
+
+	return u.String(), nil
+}
+
+// newLFSClient makes a client for the LFS server of the remote.
+// HTTP credentials are required for HTTP remotes same as for Git itself, for other remotes they are used if available.
+// Credentials passed through by the caller, if any, are used as-is.
+// HTTPS options are the same as for the remote, even if it was not HTTP.
+// Requests are made while holding the session mutex, so they time out after git.lfsTimeout rather than block the session forever.
+// Repositories are the URLs the remote was resolved from, git.credentials entries are matched against them as well.
+func newLFSClient(remoteURL string, credentials *githttp.BasicAuth, repositories ...string) (*lfsClient, error) {
+	endpoint, err := lfsEndpoint(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories = append(repositories, remoteURL)
+
+	https, err := repositoryHTTPSOptions(endpoint, repositories...)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := https.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	client.Timeout = viper.GetDuration("git.lfsTimeout")
+	if client.Timeout <= 0 {
+		return nil, fmt.Errorf("git.lfsTimeout must be positive, got %s", client.Timeout)
+	}
+
+	if credentials != nil {
+		return &lfsClient{endpoint: endpoint, auth: credentials, client: client}, nil
+	}
+
+	entry, err := repositoryCredentials(repositories...)
+	if err != nil {
+		return nil, err
+	}
+
+	var auth *githttp.BasicAuth
+	if entry != nil && entry.hasCredentials() {
+		auth, err = entry.authHTTP(endpoint)
+	} else {
+		auth, err = authHTTP(endpoint)
+	}
+	if err != nil && strings.HasPrefix(remoteURL, "http") {
+		return nil, err
+	}
+
+	return &lfsClient{endpoint: endpoint, auth: auth, client: client}, nil
+}
+
+// do sends the request, and returns the response if it was successful.
+// Credentials are only sent to the LFS server itself - actions might point elsewhere, i.e. to a pre-signed URL of an object storage,
+// then the server tells what headers to use.
+func (client *lfsClient) do(request *http.Request, header map[string]string) (*http.Response, error) {
+	if endpoint, err := url.Parse(client.endpoint); err == nil && client.auth != nil && request.URL.Host == endpoint.Host {
+		request.SetBasicAuth(client.auth.Username, client.auth.Password)
+	}
+	for k, v := range header {
+		request.Header.Set(k, v)
+	}
+
+	response, err := client.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+
+		if response.StatusCode == http.StatusUnauthorized && request.Header.Get("Authorization") != "" {
+			credentialHelpers.reject(client.auth)
+		}
+
+		var lfsErr lfsError
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, lfsMaxPointerSize))
+		if err := json.Unmarshal(body, &lfsErr); err != nil || lfsErr.Message == "" {
+			lfsErr.Message = strings.TrimSpace(string(body))
+		}
+		return nil, fmt.Errorf("LFS request %s %s failed with %s: %s", request.Method, request.URL.Redacted(), response.Status, lfsErr.Message)
+	}
+
+	return response, nil
+}
+
+// batch asks the server what to do to upload or download the object
+func (client *lfsClient) batch(operation string, pointer *lfsPointer) (*lfsObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: operation,
+		Transfers: []string{"basic"},
+		Objects:   []lfsObject{{OID: pointer.OID, Size: pointer.Size}},
+		HashAlgo:  "sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, client.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", lfsMediaType)
+	request.Header.Set("Content-Type", lfsMediaType)
+
+	response, err := client.do(request, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var batch lfsBatchResponse
+	if err := json.NewDecoder(response.Body).Decode(&batch); err != nil {
+		return nil, err
+	}
+
+	if batch.Transfer != "" && batch.Transfer != "basic" {
+		return nil, fmt.Errorf("LFS server chose unsupported transfer adapter %s", batch.Transfer)
+	}
+
+	for _, object := range batch.Objects {
+		if object.OID != pointer.OID {
+			continue
+		}
+		if object.Error != nil {
+			return nil, fmt.Errorf("LFS server could not %s object %s: %d %s", operation, pointer.OID, object.Error.Code, object.Error.Message)
+		}
+		return &object, nil
+	}
+
+	return nil, fmt.Errorf("LFS server did not return object %s", pointer.OID)
+}
+
+// upload stores the content on the server unless it already had it, and returns a pointer to it
+func (client *lfsClient) upload(content []byte) (*lfsPointer, error) {
+	pointer := newLFSPointer(content)
+
+	object, err := client.batch("upload", pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	// No actions means the server already has it
+	upload, ok := object.Actions["upload"]
+	if !ok {
+		return pointer, nil
+	}
+
+	request, err := http.NewRequest(http.MethodPut, upload.Href, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := client.do(request, upload.Header)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if verify, ok := object.Actions["verify"]; ok {
+		body, err := json.Marshal(lfsObject{OID: pointer.OID, Size: pointer.Size})
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := http.NewRequest(http.MethodPost, verify.Href, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", lfsMediaType)
+		request.Header.Set("Content-Type", lfsMediaType)
+
+		response, err := client.do(request, verify.Header)
+		if err != nil {
+			return nil, err
+		}
+		response.Body.Close()
+	}
+
+	return pointer, nil
+}
+
+// download reads the content the pointer refers to, making sure it is what was expected
+func (client *lfsClient) download(pointer *lfsPointer) ([]byte, error) {
+	object, err := client.batch("download", pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	download, ok := object.Actions["download"]
+	if !ok {
+		return nil, fmt.Errorf("LFS server did not return download action for object %s", pointer.OID)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, download.Href, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(request, download.Header)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, pointer.Size+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if actual := newLFSPointer(content); *actual != *pointer {
+		return nil, errors.New("LFS object " + pointer.OID + " downloaded did not match the pointer")
+	}
+
+	return content, nil
+}
+
+// lfsStore uploads the state to LFS and returns the pointer file to write in place of it, if git.lfs was enabled.
+// Otherwise the state is returned as-is.
+func (storageSession *storageSession) lfsStore(state []byte) ([]byte, error) {
+	if !viper.GetBool("git.lfs") {
+		return state, nil
+	}
+
+	client, err := newLFSClient(storageSession.remoteURL, storageSession.credentials, storageSession.repositoryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	pointer, err := client.upload(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return pointer.Bytes(), nil
+}
+
+// lfsResolve downloads the content from LFS if the file was a pointer, otherwise the file is returned as-is.
+// Pointers are resolved even if git.lfs is disabled, so the states stored while it was enabled can still be read.
+func (storageSession *storageSession) lfsResolve(file []byte) ([]byte, error) {
+	pointer := parseLFSPointer(file)
+	if pointer == nil {
+		return file, nil
+	}
+
+	client, err := newLFSClient(storageSession.remoteURL, storageSession.credentials, storageSession.repositoryURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.download(pointer)
+}
+
+// lfsTrack makes sure the state is tracked by LFS in .gitattributes, the same way git lfs track would do it, and stages it.
+// Without it, LFS clients and hosting would treat the pointer as a regular file, and the object it refers to as unused.
+func (storageSession *storageSession) lfsTrack(path string) error {
+	// Same as git lfs track, spaces are escaped as they would separate the pattern from the attributes
+	pattern := strings.ReplaceAll(path, " ", "[[:space:]]")
+
+	attributes, err := storageSession.readFile(lfsAttributesPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(attributes), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == pattern && strings.Contains(line, "filter=lfs") {
+			return nil
+		}
+	}
+
+	if len(attributes) > 0 && !bytes.HasSuffix(attributes, []byte("\n")) {
+		attributes = append(attributes, '\n')
+	}
+	attributes = append(attributes, []byte(pattern+" "+lfsAttributes+"\n")...)
+
+	if err := storageSession.writeFile(lfsAttributesPath, attributes); err != nil {
+		return err
+	}
+
+	return storageSession.add(lfsAttributesPath)
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"log"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// ListStateLocks fetches all locks branches and reads the lock metadata from each of them.
+// Locks branches deleted remotely are pruned, so only the locks that are currently held are returned.
+func (storageClient *StorageClient) ListStateLocks(p types.RequestMetadataParams) (map[string][]byte, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	// Lock branches are re-created from scratch every time, they are not expected to fast-forward
+	if err := storageSession.fetchWithOptions(git.FetchOptions{
+		RefSpecs: locksRefSpecs,
+		Force:    true,
+		Prune:    true,
+	}); err != nil {
+		return nil, err
+	}
+
+	refs, err := storageSession.repository.References()
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+
+	prefix := ref(getLockBranchName(&RequestMetadataParams{}), true).String()
+	locks := make(map[string][]byte)
+	if err := refs.ForEach(func(reference *plumbing.Reference) error {
+		name := reference.Name().String()
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		state := strings.TrimPrefix(name, prefix)
+
+		commit, err := storageSession.repository.CommitObject(reference.Hash())
+		if err != nil {
+			return err
+		}
+
+		lock, err := storageSession.readFileAt(commit, getLockPath(&RequestMetadataParams{State: state}))
+		if err != nil {
+			// Not a lock branch made by this backend, ignore it
+			log.Printf("Skipping %s: %s", name, err)
+			return nil
+		}
+
+		locks[state] = lock
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
+
+// ParamsForState makes a copy of params for another state in the same repository.
+// The copy shares the session with the original, so it must not be disconnected on it's own.
+func (storageClient *StorageClient) ParamsForState(p types.RequestMetadataParams, state string) types.RequestMetadataParams {
+	params := *p.(*RequestMetadataParams)
+	params.State = state
+
+	return &params
+}
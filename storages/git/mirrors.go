@@ -0,0 +1,314 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+const (
+	// mirrorPolicyLog only logs failures to push to mirrors
+	mirrorPolicyLog = "log"
+
+	// mirrorPolicyFatal fails the request before anything is pushed if any of the mirrors can't be reached
+	mirrorPolicyFatal = "fatal"
+)
+
+func init() {
+	viper.SetDefault("git.mirrorPolicy", mirrorPolicyLog)
+}
+
+// mirrorURLs renders git.mirrors templates for the repository.
+// Templates can refer to the Repository URL, and the Host and Path it consists of.
+func mirrorURLs(repository string) ([]string, error) {
+	templates := viper.GetStringSlice("git.mirrors")
+	if len(templates) == 0 {
+		return nil, nil
+	}
+
+	e, err := transport.NewEndpoint(repository)
+	if err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		Repository, Host, Path string
+	}{
+		Repository: repository,
+		Host:       e.Host,
+		Path:       strings.TrimPrefix(e.Path, "/"),
+	}
+
+	urls := make([]string, 0, len(templates))
+	for _, text := range templates {
+		tmpl, err := template.New("git.mirrors").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+
+		var url strings.Builder
+		if err := tmpl.Execute(&url, data); err != nil {
+			return nil, err
+		}
+
+		resolved, err := resolveRepository(url.String())
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, resolved)
+	}
+
+	return urls, nil
+}
+
+// mirrorRemotes makes sure there's a remote for each mirror, named mirror-0, mirror-1 and so on, and returns them.
+// Remotes left from previous configuration, i.e. in git.cacheDir, are re-created if the URL has changed.
+func (storageSession *storageSession) mirrorRemotes() ([]*git.Remote, error) {
+	urls, err := mirrorURLs(storageSession.remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	remotes := make([]*git.Remote, 0, len(urls))
+	for i, url := range urls {
+		name := fmt.Sprintf("mirror-%d", i)
+
+		remote, err := storageSession.repository.Remote(name)
+		if err == nil && (len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != url) {
+			if err := storageSession.repository.DeleteRemote(name); err != nil {
+				return nil, err
+			}
+			err = git.ErrRemoteNotFound
+		}
+		if err == git.ErrRemoteNotFound {
+			remote, err = storageSession.repository.CreateRemote(&config.RemoteConfig{
+				Name: name,
+				URLs: []string{url},
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		remotes = append(remotes, remote)
+	}
+
+	return remotes, nil
+}
+
+// checkMirrors makes sure every mirror can be reached if git.mirrorPolicy is fatal, to refuse the request before anything was pushed.
+// Once the main repository has accepted the change, there's no taking it back, so failures from then on are only logged by pushMirrors.
+func (storageSession *storageSession) checkMirrors() error {
+	if viper.GetString("git.mirrorPolicy") != mirrorPolicyFatal {
+		return nil
+	}
+
+	remotes, err := storageSession.mirrorRemotes()
+	if err != nil {
+		return err
+	}
+
+	for _, remote := range remotes {
+		if err := checkMirror(remote); err != nil {
+			return fmt.Errorf("Mirror %s can't be reached: %w", remote.Config().URLs[0], err)
+		}
+	}
+
+	return nil
+}
+
+// checkMirror lists refs on the mirror to see if it can be reached with the credentials it would be pushed with
+func checkMirror(remote *git.Remote) error {
+	auth, err := auth(&RequestMetadataParams{Repository: remote.Config().URLs[0]})
+	if err != nil {
+		return err
+	}
+
+	https, err := remoteHTTPSOptions(remote.Config().URLs[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = remote.List(&git.ListOptions{
+		Auth:         auth,
+		CABundle:     https.caBundle,
+		ClientCert:   https.clientCert,
+		ClientKey:    https.clientKey,
+		ProxyOptions: https.proxy,
+	})
+	reportCredentials(auth, err)
+	// Mirror that was just created has nothing in it yet, but it is there
+	if err != nil && err != transport.ErrEmptyRemoteRepository {
+		return err
+	}
+
+	return nil
+}
+
+// pushMirror force-pushes to the mirror - it follows origin, whatever happens there.
+// If the mirror is behind beyond the shallow clone boundary, complete history of the branch is fetched to push it.
+// Depending on who noticed that first, it is either missing objects locally or the mirror rejecting the pack.
+func (storageSession *storageSession) pushMirror(remote *git.Remote, branch string, refSpecs []config.RefSpec, prune bool) error {
+	auth, err := auth(&RequestMetadataParams{Repository: remote.Config().URLs[0]})
+	if err != nil {
+		return err
+	}
+
+	https, err := remoteHTTPSOptions(remote.Config().URLs[0])
+	if err != nil {
+		return err
+	}
+
+	pushOptions := &git.PushOptions{
+		RemoteName:   remote.Config().Name,
+		RefSpecs:     refSpecs,
+		Auth:         auth,
+		CABundle:     https.caBundle,
+		ClientCert:   https.clientCert,
+		ClientKey:    https.clientKey,
+		ProxyOptions: https.proxy,
+		Prune:        prune,
+	}
+
+	err = remote.Push(pushOptions)
+	if err == plumbing.ErrObjectNotFound || (isRejectedPack(err) && storageSession.isShallow()) {
+		if err := storageSession.fetchHistory(branch); err != nil {
+			return err
+		}
+		err = remote.Push(pushOptions)
+	}
+	reportCredentials(auth, err)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+
+	return nil
+}
+
+// isRejectedPack checks if the remote refused what was pushed to it because objects were missing from the pack.
+// go-git only has the status reported by the remote as text - "unpack error: <reason>" if the pack was refused as a whole,
+// or "command error on <ref>: <reason>" for each ref that was refused. Refs are only looked at if the reason is about
+// the objects sent, other rejections (i.e. by hooks or branch protection) would not be helped by fetching the history.
+func isRejectedPack(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	if strings.HasPrefix(msg, "unpack error") {
+		return true
+	}
+
+	return strings.HasPrefix(msg, "command error on") &&
+		(strings.Contains(msg, "missing necessary objects") || strings.Contains(msg, "shallow update not allowed"))
+}
+
+// pushMirrors pushes to all mirrors. It is called once the main repository has the change, so failures are only logged -
+// mirrors that missed it catch up with the next one, or with SyncMirrors. See checkMirrors for git.mirrorPolicy.
+// Branch is the Ref the pushed refs are based on, it is used to fetch the history if needed.
+func (storageSession *storageSession) pushMirrors(branch string, refSpecs ...config.RefSpec) {
+	remotes, err := storageSession.mirrorRemotes()
+	if err != nil {
+		log.Printf("Failed to set up mirrors of %s: %s", storageSession.remoteURL, err)
+		return
+	}
+
+	for _, remote := range remotes {
+		if err := storageSession.pushMirror(remote, branch, refSpecs, false); err != nil {
+			log.Printf("Failed to push %s to mirror %s: %s", refSpecs, remote.Config().URLs[0], err)
+		}
+	}
+}
+
+// mirrorBranch pushes the branch as it is locally to all mirrors
+func (storageSession *storageSession) mirrorBranch(params *RequestMetadataParams, branch string) {
+	storageSession.pushMirrors(params.Ref, config.RefSpec(fmt.Sprintf("+%s:%s", ref(branch, false), ref(branch, false))))
+}
+
+// checkLockMirrors is checkMirrors for lock changes, which are only pushed to mirrors if git.mirrorLocks was enabled
+func (storageSession *storageSession) checkLockMirrors() error {
+	if !viper.GetBool("git.mirrorLocks") {
+		return nil
+	}
+
+	return storageSession.checkMirrors()
+}
+
+// mirrorLock pushes the lock branch to all mirrors if git.mirrorLocks was enabled, or deletes it there if it was released
+func (storageSession *storageSession) mirrorLock(params *RequestMetadataParams, released bool) {
+	if !viper.GetBool("git.mirrorLocks") {
+		return
+	}
+
+	if released {
+		storageSession.pushMirrors(params.Ref, config.RefSpec(":"+ref(getLockBranchName(params), false)))
+		return
+	}
+
+	storageSession.mirrorBranch(params, getLockBranchName(params))
+}
+
+// SyncMirrors force-pushes complete history of Ref to all mirrors, along with locks if git.mirrorLocks was enabled.
+// Locks that are no longer held are deleted from mirrors. Any failure is returned regardless of git.mirrorPolicy.
+func (storageClient *StorageClient) SyncMirrors(p types.RequestMetadataParams) ([]string, error) {
+	params := p.(*RequestMetadataParams)
+
+	storageSession := params.session
+
+	remotes, err := storageSession.mirrorRemotes()
+	if err != nil {
+		return nil, err
+	}
+	if len(remotes) == 0 {
+		return nil, fmt.Errorf("No mirrors configured for %s (git.mirrors)", params.Repository)
+	}
+
+	if err := storageSession.fetchHistory(params.Ref); err != nil {
+		return nil, err
+	}
+
+	refSpecs := []config.RefSpec{
+		config.RefSpec(fmt.Sprintf("+%s:%s", ref(params.Ref, true), ref(params.Ref, false))),
+	}
+
+	mirrorLocks := viper.GetBool("git.mirrorLocks")
+	if mirrorLocks {
+		if err := storageSession.fetchWithOptions(git.FetchOptions{
+			RefSpecs: locksRefSpecs,
+			Force:    true,
+			Prune:    true,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	synced := make([]string, 0, len(remotes))
+	for _, remote := range remotes {
+		url := remote.Config().URLs[0]
+
+		if err := storageSession.pushMirror(remote, params.Ref, refSpecs, false); err != nil {
+			return synced, fmt.Errorf("Failed to sync %s to mirror %s: %w", params.Ref, url, err)
+		}
+
+		if mirrorLocks {
+			if err := storageSession.pushMirror(remote, params.Ref, []config.RefSpec{
+				config.RefSpec("+refs/remotes/origin/locks/*:refs/heads/locks/*"),
+			}, true); err != nil {
+				return synced, fmt.Errorf("Failed to sync locks to mirror %s: %w", url, err)
+			}
+		}
+
+		synced = append(synced, url)
+	}
+
+	return synced, nil
+}
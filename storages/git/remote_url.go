@@ -0,0 +1,234 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	sshGit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/kevinburke/ssh_config"
+	"github.com/mitchellh/go-homedir"
+)
+
+func init() {
+	// go-git resolves HostName and Port when it connects, make sure it sees the same config as we do
+	sshGit.DefaultSSHConfig = sshConfig{}
+}
+
+// gitConfigFiles lists git config files the same way git CLI does, in the order they are read
+func gitConfigFiles() ([]string, error) {
+	files := []string{"/etc/gitconfig"}
+
+	if global, ok := os.LookupEnv("GIT_CONFIG_GLOBAL"); ok {
+		return append(files, global), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(home, ".config")
+	}
+
+	return append(files, filepath.Join(xdg, "git", "config"), filepath.Join(home, ".gitconfig")), nil
+}
+
+// insteadOfRules reads url.<base>.insteadOf from git config files, mapping the prefixes to their replacements
+func insteadOfRules() (map[string]string, error) {
+	files, err := gitConfigFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make(map[string]string)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := config.New()
+		if err := config.NewDecoder(bytes.NewReader(content)).Decode(cfg); err != nil {
+			return nil, fmt.Errorf("Failed to parse git config %s: %w", file, err)
+		}
+
+		for _, subsection := range cfg.Section("url").Subsections {
+			for _, prefix := range subsection.Options.GetAll("insteadOf") {
+				rules[prefix] = subsection.Name
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// applyInsteadOf rewrites the URL by the longest matching url.<base>.insteadOf prefix, same as git does
+func applyInsteadOf(repository string) (string, error) {
+	rules, err := insteadOfRules()
+	if err != nil {
+		return "", err
+	}
+
+	longest := ""
+	for prefix := range rules {
+		if strings.HasPrefix(repository, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return repository, nil
+	}
+
+	return rules[longest] + strings.TrimPrefix(repository, longest), nil
+}
+
+// sshConfig reads ~/.ssh/config and /etc/ssh/ssh_config, first value found wins same as in ssh.
+// Files are read on every lookup, so changes are picked up without restarting the backend.
+type sshConfig struct{}
+
+// sshConfigFiles lists SSH config files in the order they are read
+func sshConfigFiles() []string {
+	files := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "config"))
+	}
+	return append(files, "/etc/ssh/ssh_config")
+}
+
+// GetAll returns all values for the key from all hosts matching the alias, i.e. IdentityFile
+func (sshConfig) GetAll(alias, key string) (values []string) {
+	for _, file := range sshConfigFiles() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Ignoring SSH config %s: %s", file, err)
+			}
+			continue
+		}
+
+		cfg, err := ssh_config.DecodeBytes(content)
+		if err != nil {
+			log.Printf("Ignoring SSH config %s: %s", file, err)
+			continue
+		}
+
+		fileValues, err := sshConfigGetAll(cfg, alias, key)
+		if err != nil {
+			log.Printf("Ignoring SSH config %s: %s", file, err)
+			continue
+		}
+		values = append(values, fileValues...)
+	}
+
+	return values
+}
+
+// sshConfigGetAll is cfg.GetAll that does not panic on unsupported Match directives
+func sshConfigGetAll(cfg *ssh_config.Config, alias, key string) (values []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return cfg.GetAll(alias, key)
+}
+
+// Get returns the first value for the key from hosts matching the alias
+func (config sshConfig) Get(alias, key string) string {
+	if values := config.GetAll(alias, key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// sshHostWithPort resolves the address to connect to for the SSH endpoint, as go-git does it with the SSH config
+func sshHostWithPort(e *transport.Endpoint) string {
+	host, port := e.Host, e.Port
+	if hostName := (sshConfig{}).Get(e.Host, "HostName"); hostName != "" {
+		host = hostName
+		if configPort, err := strconv.Atoi((sshConfig{}).Get(e.Host, "Port")); err == nil {
+			port = configPort
+		}
+	}
+	if port == 0 {
+		port = 22
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// sshIdentityFiles returns IdentityFile from SSH config for the SSH endpoint, with ~ and tokens expanded
+func sshIdentityFiles(e *transport.Endpoint) ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(sshHostWithPort(e))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := strings.NewReplacer("%%", "%", "%d", home, "%h", host, "%r", e.User)
+
+	var files []string
+	for _, file := range (sshConfig{}).GetAll(e.Host, "IdentityFile") {
+		file, err := homedir.Expand(tokens.Replace(file))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// resolveRepository makes the repository URL the git CLI would use:
+// url.<base>.insteadOf rules from git config are applied, and for SSH, User from SSH config is added unless the URL had one.
+// SSH host aliases are left as-is, HostName and Port are resolved by go-git when it connects.
+func resolveRepository(repository string) (string, error) {
+	repository, err := applyInsteadOf(repository)
+	if err != nil {
+		return "", err
+	}
+
+	e, err := transport.NewEndpoint(repository)
+	if err != nil || e.Protocol != "ssh" || e.User != "" {
+		return repository, nil
+	}
+
+	user := (sshConfig{}).Get(e.Host, "User")
+	if user == "" {
+		return repository, nil
+	}
+
+	// Keep SCP-like syntax as-is, the path is relative to the home directory there
+	if !strings.Contains(repository, "://") {
+		return user + "@" + repository, nil
+	}
+
+	u, err := url.Parse(repository)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.User(user)
+
+	return u.String(), nil
+}
@@ -0,0 +1,178 @@
+package git
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/spf13/viper"
+)
+
+const (
+	// defaultPushRetries is how many times a rejected push is retried unless git.pushRetries says otherwise
+	defaultPushRetries = 3
+
+	// defaultPushRetryBackoff is the delay before the first retry unless git.pushRetryBackoff says otherwise
+	defaultPushRetryBackoff = 500 * time.Millisecond
+
+	// maxPushRetryBackoff is the longest delay between retries, no matter how many of them there were
+	maxPushRetryBackoff = time.Minute
+)
+
+func init() {
+	viper.SetDefault("git.pushRetries", defaultPushRetries)
+	viper.SetDefault("git.pushRetryBackoff", defaultPushRetryBackoff)
+}
+
+// isNonFastForward returns true if the push was rejected because the remote has moved on since our pull
+func isNonFastForward(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), git.ErrNonFastForwardUpdate.Error())
+}
+
+// rejectedAsNonFastForward returns true if the push of the branch was rejected because the remote has moved on since our pull.
+// To tell that, go-git looks for the remote head in our history, and in a shallow clone it runs into the boundary if the head is not there.
+// Only then missing object means it's not a fast-forward, otherwise it's an error of its own.
+func (storageSession *storageSession) rejectedAsNonFastForward(branch string, err error) bool {
+	if isNonFastForward(err) {
+		return true
+	}
+
+	if err != plumbing.ErrObjectNotFound || !storageSession.isShallow() {
+		return false
+	}
+
+	head, err := storageSession.remoteHead(branch)
+	if err != nil {
+		log.Printf("Failed to look up %s remotely: %s", branch, err)
+		return false
+	}
+	if head.IsZero() {
+		return false
+	}
+
+	found, err := storageSession.inShallowHistory(branch, head)
+	if err != nil {
+		log.Printf("Failed to look up %s in the history of %s: %s", head, branch, err)
+		return false
+	}
+
+	return !found
+}
+
+// inShallowHistory checks if the commit is in the history of the local branch, down to the shallow clone boundary.
+// Unlike go-git, it does not look beyond the boundary, but any other missing object is still an error.
+func (storageSession *storageSession) inShallowHistory(branch string, hash plumbing.Hash) (bool, error) {
+	local, err := storageSession.repository.Reference(ref(branch, false), true)
+	if err != nil {
+		return false, err
+	}
+
+	shallows, err := storageSession.repository.Storer.Shallow()
+	if err != nil {
+		return false, err
+	}
+	boundary := make(map[plumbing.Hash]bool, len(shallows))
+	for _, shallow := range shallows {
+		boundary[shallow] = true
+	}
+
+	seen := make(map[plumbing.Hash]bool)
+	queue := []plumbing.Hash{local.Hash()}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == hash {
+			return true, nil
+		}
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+
+		commit, err := storageSession.repository.CommitObject(current)
+		if err != nil {
+			return false, err
+		}
+		if !boundary[current] {
+			queue = append(queue, commit.ParentHashes...)
+		}
+	}
+
+	return false, nil
+}
+
+// retryPush calls fn that commits a change to Ref and pushes it.
+// If the push was rejected as not a fast-forward - something else has pushed to Ref since our pull,
+// most likely a change to some other state. Then the local Ref is reset to the latest remote and fn is called again,
+// which is as good as a rebase as all fn does is re-applying the same change to the state file.
+// It gives up after git.pushRetries attempts, waiting longer after each one starting with git.pushRetryBackoff.
+func (storageSession *storageSession) retryPush(params *RequestMetadataParams, fn func() error) error {
+	retries := viper.GetInt("git.pushRetries")
+	if retries < 0 {
+		return fmt.Errorf("git.pushRetries must not be negative, got %d", retries)
+	}
+	backoff := viper.GetDuration("git.pushRetryBackoff")
+	if backoff < 0 {
+		return fmt.Errorf("git.pushRetryBackoff must not be negative, got %s", backoff)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !storageSession.rejectedAsNonFastForward(params.Ref, err) || attempt > retries {
+			return err
+		}
+
+		delay := retryDelay(backoff, attempt)
+		log.Printf("Push to %s was rejected as %s has changed remotely, retrying in %s (%d/%d)",
+			params.Repository, params.Ref, delay, attempt, retries)
+		time.Sleep(delay)
+
+		if err := storageSession.resetToRemote(params.Ref); err != nil {
+			return err
+		}
+	}
+}
+
+// retryDelay is how long to wait before the retry after this attempt.
+// Backoff doubles with each attempt up to maxPushRetryBackoff, and jitter keeps competing backends from retrying in lockstep.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempt && delay < maxPushRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPushRetryBackoff {
+		delay = maxPushRetryBackoff
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(backoff)+1))
+}
+
+// resetToRemote fetches the branch and resets local branch to it, dropping local commits that were not pushed.
+// It assumes the branch is currently checked out.
+func (storageSession *storageSession) resetToRemote(branch string) error {
+	if err := storageSession.fetch([]config.RefSpec{
+		config.RefSpec(fmt.Sprintf("+%s:%s", ref(branch, false), ref(branch, true))),
+	}); err != nil {
+		return err
+	}
+
+	remote, err := storageSession.repository.Reference(ref(branch, true), true)
+	if err != nil {
+		return err
+	}
+
+	tree, err := storageSession.repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return tree.Reset(&git.ResetOptions{
+		Commit: remote.Hash(),
+		Mode:   git.HardReset,
+	})
+}
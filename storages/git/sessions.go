@@ -0,0 +1,251 @@
+package git
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/spf13/viper"
+)
+
+const (
+	// ConcurrencyRepository shares one session among all requests to the same repository
+	ConcurrencyRepository = "repository"
+	// ConcurrencyRef gives each Ref in the repository it's own session
+	ConcurrencyRef = "ref"
+	// ConcurrencyState gives each state in the repository it's own session
+	ConcurrencyState = "state"
+)
+
+// sessionKey calculates the key in StorageClient.sessions for this params set,
+// based on the git.concurrency mode configured by the user.
+// Credentials passed through by the caller are part of the key, see credentialsHash.
+func sessionKey(params *RequestMetadataParams) (string, error) {
+	var key string
+	switch mode := viper.GetString("git.concurrency"); mode {
+	case "", ConcurrencyRepository:
+		key = params.Repository
+	case ConcurrencyRef:
+		key = fmt.Sprintf("%s?ref=%s", params.Repository, params.Ref)
+	case ConcurrencyState:
+		key = fmt.Sprintf("%s?ref=%s//%s", params.Repository, params.Ref, params.State)
+	default:
+		return "", fmt.Errorf("Unknown git.concurrency mode %q, must be one of: %s, %s, %s",
+			mode, ConcurrencyRepository, ConcurrencyRef, ConcurrencyState)
+	}
+
+	if params.credentials != nil {
+		key += "#" + credentialsHash(params.credentials)
+	}
+
+	return key, nil
+}
+
+// sessionsJanitorInterval is how often the janitor looks after sessions
+const sessionsJanitorInterval = time.Minute
+
+// sessionsLimits is what the janitor enforces on sessions, zero values mean no limit
+type sessionsLimits struct {
+	// idleTimeout is how long a session may stay unused before it gets evicted
+	idleTimeout time.Duration
+
+	// maxSessions is how many sessions may be kept at once, least recently used sessions are evicted first
+	maxSessions int
+
+	// recloneInterval is how long a session may keep it's storage before it gets dropped and cloned again
+	recloneInterval time.Duration
+
+	// reportInterval is how often to log resources used by each session
+	reportInterval time.Duration
+}
+
+// enabled returns true if there's anything for the janitor to do
+func (limits sessionsLimits) enabled() bool {
+	return limits.idleTimeout > 0 || limits.maxSessions > 0 || limits.recloneInterval > 0 || limits.reportInterval > 0
+}
+
+// startJanitor reads sessions limits configured by the user and starts a background routine to enforce them.
+// It does nothing if no limits were configured.
+func (storageClient *StorageClient) startJanitor() {
+	limits := sessionsLimits{
+		idleTimeout:     viper.GetDuration("git.sessionIdleTimeout"),
+		maxSessions:     viper.GetInt("git.maxSessions"),
+		recloneInterval: viper.GetDuration("git.sessionRecloneInterval"),
+		reportInterval:  viper.GetDuration("git.sessionReportInterval"),
+	}
+
+	if !limits.enabled() {
+		return
+	}
+
+	go func() {
+		lastReport := time.Now()
+		ticker := time.NewTicker(sessionsJanitorInterval)
+		for now := range ticker.C {
+			storageClient.cleanupSessions(now, limits)
+
+			if limits.reportInterval > 0 && now.Sub(lastReport) >= limits.reportInterval {
+				storageClient.reportSessions(now)
+				lastReport = now
+			}
+		}
+	}()
+}
+
+// cleanupSessions evicts idle and least recently used sessions and drops sessions storage that is due for a re-clone.
+// Sessions currently in use are left alone - they will be looked at next time.
+func (storageClient *StorageClient) cleanupSessions(now time.Time, limits sessionsLimits) {
+	storageClient.sessionsMutex.Lock()
+	defer storageClient.sessionsMutex.Unlock()
+
+	idle := make([]*storageSession, 0, len(storageClient.sessions))
+	defer func() {
+		for _, storageSession := range idle {
+			storageSession.mutex.Unlock()
+		}
+	}()
+
+	for _, storageSession := range storageClient.sessions {
+		if !storageSession.mutex.TryLock() {
+			continue
+		}
+
+		if limits.idleTimeout > 0 && now.Sub(storageSession.lastUsed) > limits.idleTimeout {
+			log.Printf("Evicting session %s: idle for %s", storageSession.key, now.Sub(storageSession.lastUsed))
+			storageClient.evict(storageSession)
+			storageSession.mutex.Unlock()
+			continue
+		}
+
+		if limits.recloneInterval > 0 && storageSession.repository != nil && now.Sub(storageSession.clonedAt) > limits.recloneInterval {
+			log.Printf("Dropping session storage %s: cloned %s ago, it will be cloned again on next use", storageSession.key, now.Sub(storageSession.clonedAt))
+			storageSession.discardCache()
+		}
+
+		idle = append(idle, storageSession)
+	}
+
+	if limits.maxSessions <= 0 || len(storageClient.sessions) <= limits.maxSessions {
+		return
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].lastUsed.Before(idle[j].lastUsed)
+	})
+
+	for _, storageSession := range idle {
+		if len(storageClient.sessions) <= limits.maxSessions {
+			break
+		}
+
+		log.Printf("Evicting session %s: more than %d sessions, it was last used %s ago", storageSession.key, limits.maxSessions, now.Sub(storageSession.lastUsed))
+		storageClient.evict(storageSession)
+	}
+}
+
+// evict removes the session from the sessions map and releases it's resources.
+// Caller must hold both sessions map lock and session lock.
+// Disk cache, if any, stays on disk to be re-used when this session is needed again.
+func (storageClient *StorageClient) evict(storageSession *storageSession) {
+	delete(storageClient.sessions, storageSession.key)
+
+	storageSession.evicted = true
+	storageSession.closeStorage()
+	storageSession.repository = nil
+	storageSession.storer = nil
+	storageSession.fs = nil
+}
+
+// reportSessions logs resources used by each session
+func (storageClient *StorageClient) reportSessions(now time.Time) {
+	storageClient.sessionsMutex.Lock()
+	sessions := make([]*storageSession, 0, len(storageClient.sessions))
+	for _, storageSession := range storageClient.sessions {
+		sessions = append(sessions, storageSession)
+	}
+	storageClient.sessionsMutex.Unlock()
+
+	for _, storageSession := range sessions {
+		// Do not wait for sessions in use, the numbers would've been changing anyway
+		if !storageSession.mutex.TryLock() {
+			log.Printf("Session %s: in use", storageSession.key)
+			continue
+		}
+
+		stats, err := storageSession.stats()
+		lastUsed := storageSession.lastUsed
+		storageSession.mutex.Unlock()
+		if err != nil {
+			log.Printf("Session %s: failed to calculate stats: %s", storageSession.key, err)
+			continue
+		}
+
+		log.Printf("Session %s: %d objects, %d bytes %s, idle for %s", storageSession.key, stats.objects, stats.bytes, stats.location, now.Sub(lastUsed))
+	}
+}
+
+// sessionStats is a resource usage of a session
+type sessionStats struct {
+	// objects is a number of git objects in the storer, only known for in-memory sessions
+	objects int
+
+	// bytes is a total size of git objects and working tree files
+	bytes int64
+
+	// location is where these bytes are kept
+	location string
+}
+
+// stats calculates resources used by this session.
+// Caller must hold the session lock.
+func (storageSession *storageSession) stats() (sessionStats, error) {
+	if storageSession.dir != "" {
+		stats := sessionStats{location: "on disk"}
+		err := filepath.WalkDir(storageSession.dir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			stats.bytes += info.Size()
+			return nil
+		})
+		return stats, err
+	}
+
+	stats := sessionStats{location: "in memory"}
+
+	if storer, ok := storageSession.storer.(*memory.Storage); ok {
+		for _, object := range storer.ObjectStorage.Objects {
+			stats.objects++
+			stats.bytes += object.Size()
+		}
+	}
+
+	if storageSession.fs == nil {
+		return stats, nil
+	}
+
+	err := util.Walk(storageSession.fs, "/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			stats.bytes += info.Size()
+		}
+		return nil
+	})
+
+	return stats, err
+}
@@ -0,0 +1,168 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	sshGit "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultSSHKeys are the keys in ~/.ssh tried in this order when SSH_PRIVATE_KEY was not set
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshKeyFiles lists SSH private keys to try in order.
+// Keys from SSH_PRIVATE_KEY must exist, while IdentityFile from SSH config for the host, or the default ones, are skipped if they don't.
+func sshKeyFiles(e *transport.Endpoint) (files []string, explicit bool, err error) {
+	if keys, ok := os.LookupEnv("SSH_PRIVATE_KEY"); ok && keys != "" {
+		for _, key := range filepath.SplitList(keys) {
+			key, err := homedir.Expand(key)
+			if err != nil {
+				return nil, false, err
+			}
+			files = append(files, key)
+		}
+		return files, true, nil
+	}
+
+	if files, err := sshIdentityFiles(e); err != nil || len(files) > 0 {
+		return files, false, err
+	}
+
+	// Ok then, try to discover SSH keys in the user home
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, key := range defaultSSHKeys {
+		files = append(files, filepath.Join(home, ".ssh", key))
+	}
+
+	return files, false, nil
+}
+
+// sshKeyPassphrase discovers environment for the passphrase of SSH private keys, it is the same for all of them
+func sshKeyPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv("SSH_PRIVATE_KEY_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+
+	if passphraseFile, ok := os.LookupEnv("SSH_PRIVATE_KEY_PASSPHRASE_FILE"); ok {
+		return credentialFiles.readTrimmed(passphraseFile)
+	}
+
+	return "", nil
+}
+
+// parseSSHKey parses SSH private key, decrypting it if needed
+func parseSSHKey(pem []byte, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(pem)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			return nil, errors.New("SSH key is encrypted but passphrase was not set (SSH_PRIVATE_KEY_PASSPHRASE/SSH_PRIVATE_KEY_PASSPHRASE_FILE)")
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	}
+
+	return signer, err
+}
+
+// sshCertSigner makes a signer presenting the OpenSSH certificate from keyFile-cert.pub, same as ssh does it.
+// If returned null - there was no certificate, or it has already expired.
+func sshCertSigner(keyFile string, signer ssh.Signer) (ssh.Signer, error) {
+	certFile := keyFile + "-cert.pub"
+	content, err := ioutil.ReadFile(certFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse SSH certificate %s: %w", certFile, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", certFile)
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+		log.Printf("SSH certificate %s has expired, using the key without it", certFile)
+		return nil, nil
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// sshSigners loads the SSH private key, along with its certificate if there was one.
+// Certificate goes first, so the key alone is only tried if the server didn't accept it.
+func sshSigners(keyFile, passphrase string) ([]ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := parseSSHKey(pem, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse SSH key %s: %w", keyFile, err)
+	}
+
+	certSigner, err := sshCertSigner(keyFile, signer)
+	if err != nil {
+		return nil, err
+	}
+	if certSigner != nil {
+		return []ssh.Signer{certSigner, signer}, nil
+	}
+
+	return []ssh.Signer{signer}, nil
+}
+
+// sshPublicKeys offers the keys in order, along with their certificates.
+// Unless the keys were set explicitly, those that don't exist or can't be used are skipped.
+func sshPublicKeys(e *transport.Endpoint, files []string, explicit bool, passphrase string) (*sshGit.PublicKeysCallback, error) {
+	var signers []ssh.Signer
+	for _, file := range files {
+		keySigners, err := sshSigners(file, passphrase)
+		if err != nil {
+			if explicit {
+				return nil, err
+			}
+			if !os.IsNotExist(err) {
+				log.Printf("%s, skipping it", err)
+			}
+			continue
+		}
+		signers = append(signers, keySigners...)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("No SSH keys found, tried %s", strings.Join(files, ", "))
+	}
+
+	user := e.User
+	if user == "" {
+		user = "git"
+	}
+
+	return &sshGit.PublicKeysCallback{
+		User: user,
+		Callback: func() ([]ssh.Signer, error) {
+			return signers, nil
+		},
+	}, nil
+}
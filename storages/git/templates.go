@@ -0,0 +1,120 @@
+package git
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/viper"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
+)
+
+// commitTemplateData is what commit identity and message templates can refer to
+type commitTemplateData struct {
+	// Action is what the commit does - Lock, Update or Delete
+	Action string
+
+	Repository, Ref, State string
+
+	// LockInfo of the lock held on the state, if known - empty otherwise
+	LockInfo types.LockInfo
+
+	// UserName, Username and Hostname of the backend process
+	UserName, Username, Hostname string
+}
+
+// newCommitTemplateData collects the data for commit templates
+func newCommitTemplateData(params *RequestMetadataParams, action string) (*commitTemplateData, error) {
+	user, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	userName := user.Name
+	if userName == "" {
+		userName = user.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	data := &commitTemplateData{
+		Action:     action,
+		Repository: params.Repository,
+		Ref:        params.Ref,
+		State:      params.State,
+		UserName:   userName,
+		Username:   user.Username,
+		Hostname:   host,
+	}
+	if params.lockInfo != nil {
+		data.LockInfo = *params.lockInfo
+	}
+
+	return data, nil
+}
+
+// render executes the template from the config key against the data, or the default template if it wasn't set
+func (data *commitTemplateData) render(key, defaultTemplate string) (string, error) {
+	text := viper.GetString(key)
+	if text == "" {
+		text = defaultTemplate
+	}
+
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// commitMessage renders the message for the commit using git.<action>Message template, i.e. git.updateMessage.
+// By default it is the action followed by the state path, i.e. "Update my/state.json".
+func (data *commitTemplateData) commitMessage() (string, error) {
+	return data.render("git."+strings.ToLower(data.Action)+"Message", "{{.Action}} {{.State}}")
+}
+
+// commitSignatures renders the author and committer of the commit using git.author* and git.committer* templates.
+// By default the author is the user running the backend, and committer is the same as author.
+func (data *commitTemplateData) commitSignatures() (*object.Signature, *object.Signature, error) {
+	now := time.Now()
+
+	author := &object.Signature{When: now}
+	committer := &object.Signature{When: now}
+	for _, field := range []struct {
+		key, defaultTemplate string
+		value                *string
+	}{
+		{"git.authorName", "{{.UserName}}", &author.Name},
+		{"git.authorEmail", "{{.Username}}@{{.Hostname}}", &author.Email},
+		{"git.committerName", "", &committer.Name},
+		{"git.committerEmail", "", &committer.Email},
+	} {
+		value, err := data.render(field.key, field.defaultTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		*field.value = value
+	}
+
+	if committer.Name == "" {
+		committer.Name = author.Name
+	}
+	if committer.Email == "" {
+		committer.Email = author.Email
+	}
+
+	return author, committer, nil
+}
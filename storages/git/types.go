@@ -3,16 +3,45 @@ package git
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-git/v5"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/storage"
+
+	"github.com/plumber-cd/terraform-backend-git/types"
 )
 
 // RequestMetadataParams is Git storage specific parameters
 type RequestMetadataParams struct {
 	Repository, Ref, State string
 	Amend                  bool
+
+	// session is set by Connect and holds the session this request is currently connected to
+	session *storageSession
+
+	// lockInfo is the lock held on the state while processing this request, if known
+	lockInfo *types.LockInfo
+
+	// revision is the commit made by this request, if any
+	revision string
+
+	// credentials were passed through by the caller, to be used instead of the backend's own credentials
+	credentials *githttp.BasicAuth
+}
+
+// SetLockInfo lets the backend tell which lock is held on the state, so commits can refer to it
+func (params *RequestMetadataParams) SetLockInfo(lockInfo *types.LockInfo) {
+	params.lockInfo = lockInfo
+}
+
+// DescribeEvent fills in the address of the state and the commit made by this request
+func (params *RequestMetadataParams) DescribeEvent(event *types.Event) {
+	event.Repository = params.Repository
+	event.Ref = params.Ref
+	event.State = params.State
+	event.Revision = params.revision
 }
 
 // String is a human readable representation for this params set
@@ -22,18 +51,33 @@ func (params *RequestMetadataParams) String() string {
 
 // StorageClient implementation for Git storage type
 type StorageClient struct {
-	// sessions key is repository URL, value is everything we need to interact with it
+	// sessions key is calculated by sessionKey, value is everything we need to interact with it
 	sessions map[string]*storageSession
 
 	// sessionsMutex used for locking sessions map for adding new repositories
 	sessionsMutex sync.Mutex
+
+	// janitorOnce starts the sessions janitor on first connect, when the configuration is already loaded
+	janitorOnce sync.Once
 }
 
 // storageSession represents a particular Git repository
 type storageSession struct {
+	// key is this session key in StorageClient.sessions
+	key string
+
+	// repositoryURL is the git repository URL as configured, before resolving it to remoteURL
+	repositoryURL string
+
 	// remoteURL is the git repository URL used for remote operations
 	remoteURL string
 
+	// credentials were passed through by the caller, this session is only used by requests with the same credentials
+	credentials *githttp.BasicAuth
+
+	// dir is a directory in git.cacheDir this session is stored at, empty if the session is in-memory
+	dir string
+
 	// storer used for local working tree config
 	storer storage.Storer
 
@@ -46,4 +90,13 @@ type storageSession struct {
 	// mutex since we can't be doing parallel complex operations on a single working tree, involving checkout branches and etc,
 	// we need to use the lock and make sure only one tread is "connected" (interacts with the repository usingl local working tree).
 	mutex sync.Mutex
+
+	// lastUsed is when this session was last disconnected from
+	lastUsed time.Time
+
+	// clonedAt is when this session storage was last cloned from scratch
+	clonedAt time.Time
+
+	// evicted is true once the session has been removed from StorageClient.sessions and must not be used anymore
+	evicted bool
 }
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -26,6 +28,12 @@ var (
 	ErrLockMissing = errors.New("was not locked")
 	// ErrUnauthorized indicates that the action was not authorized
 	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrForbidden indicates that the action is not allowed to anyone
+	ErrForbidden = errors.New("Forbidden")
+	// ErrNotSupported indicates that the storage type does not support requested action
+	ErrNotSupported = errors.New("not supported by this storage type")
+	// ErrRevisionNotFound indicates that requested revision did not exist
+	ErrRevisionNotFound = errors.New("revision not found")
 )
 
 // LockInfo represents a TF Lock Metadata.
@@ -62,10 +70,38 @@ type RequestMetadataParams interface {
 	String() string
 }
 
+// LockInfoReceiver is an optional interface for RequestMetadataParams implementations that want to know about the lock held on the state.
+// Backend sets it before calling the StorageClient, once it knows who is holding the lock.
+type LockInfoReceiver interface {
+	SetLockInfo(*LockInfo)
+}
+
 // RequestMetadata stores configuration passed from Terraform as HTTP request.
 type RequestMetadata struct {
 	ID, Type string
 	Params   RequestMetadataParams
+
+	// LockInfo is the lock held on the state while processing this request, once backend knows it
+	LockInfo *LockInfo
+}
+
+// Credentials are the caller's credentials, that the backend was asked to pass through to the storage.
+type Credentials struct {
+	Username, Password string
+}
+
+// credentialsKey is the request context key for Credentials
+type credentialsKey struct{}
+
+// WithCredentials returns a copy of the request carrying the caller's credentials to pass through to the storage.
+func WithCredentials(request *http.Request, credentials *Credentials) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), credentialsKey{}, credentials))
+}
+
+// CallerCredentials returns the caller's credentials to pass through to the storage, or nil if there were none.
+func CallerCredentials(request *http.Request) *Credentials {
+	credentials, _ := request.Context().Value(credentialsKey{}).(*Credentials)
+	return credentials
 }
 
 // StorageClient is a layer responsible for connection with the remote storage.
@@ -105,3 +141,192 @@ type StorageClient interface {
 	// Delete state from the storage
 	DeleteState(RequestMetadataParams) error
 }
+
+// StateVersion describes a single version of the state in the storage history.
+type StateVersion struct {
+	// Storage specific revision identifier, i.e. commit hash
+	Revision string
+
+	// Who made this change
+	Author string
+
+	// When this change was made
+	Time time.Time
+
+	// Description of the change
+	Message string
+}
+
+// CallerCredentialsUser is an optional interface for StorageClient implementations that can use the caller's credentials instead of their own.
+// Requests with credentials passed through are refused for storage types that don't implement it, as nothing would check these credentials.
+type CallerCredentialsUser interface {
+	// UsesCallerCredentials is a marker method, storage must authenticate with CallerCredentials whenever they were passed through
+	UsesCallerCredentials()
+}
+
+// StateHistoryReader is an optional interface for StorageClient implementations that keep history of state changes.
+type StateHistoryReader interface {
+	// ListStateVersions lists versions of the state for current Params set, most recent first.
+	ListStateVersions(RequestMetadataParams) ([]StateVersion, error)
+
+	// GetStateVersion reads the state as it was at the given revision.
+	// Return ErrRevisionNotFound if revision didn't exist, and ErrStateDidNotExisted if the state didn't exist at that revision.
+	GetStateVersion(RequestMetadataParams, string) ([]byte, error)
+}
+
+// StateLockLister is an optional interface for StorageClient implementations that can enumerate all locks they hold.
+type StateLockLister interface {
+	// ListStateLocks reads lock metadata of every locked state in the storage addressed by current Params set, keyed by the state path.
+	// State in Params is not used.
+	ListStateLocks(RequestMetadataParams) (map[string][]byte, error)
+
+	// ParamsForState makes a copy of Params addressing another state in the same storage, using the same connection.
+	ParamsForState(RequestMetadataParams, string) RequestMetadataParams
+}
+
+// StateLock is a lock held on a state.
+type StateLock struct {
+	// Path to the state in the storage
+	State string
+
+	LockInfo
+
+	// How long the lock has been held, according to LockInfo.Created.
+	// In JSON, it is AgeSeconds instead, see MarshalJSON.
+	Age time.Duration `json:"-"`
+}
+
+// MarshalJSON writes the lock with its age in whole seconds, as nanoseconds are not of much use to API consumers
+func (lock StateLock) MarshalJSON() ([]byte, error) {
+	// Alias does not have this method, otherwise it would recurse
+	type stateLock StateLock
+	return json.Marshal(struct {
+		stateLock
+		AgeSeconds int64
+	}{
+		stateLock:  stateLock(lock),
+		AgeSeconds: int64(lock.Age / time.Second),
+	})
+}
+
+// StateDiff is a semantic difference between two versions of the Terraform state.
+type StateDiff struct {
+	// Revisions compared, empty To means the current state
+	From, To string
+
+	// Serial and lineage of the state in both versions
+	FromSerial, ToSerial   uint64
+	FromLineage, ToLineage string
+
+	// Addresses of resource instances, i.e. module.foo.aws_instance.bar[0]
+	ResourcesAdded, ResourcesRemoved []string
+	ResourcesChanged                 []ResourceChange
+
+	// Names of root module outputs
+	OutputsAdded, OutputsRemoved, OutputsChanged []string
+}
+
+// ResourceChange describes a resource instance that exists in both versions of the state but has changed.
+type ResourceChange struct {
+	// Address of the resource instance
+	Address string
+
+	// Names of attributes that have changed, values are never reported as they might be sensitive
+	Attributes []string
+}
+
+// CompactionPolicy tells which versions of each state to keep when the history is compacted.
+// A version is kept if it matches any of the limits that were set, and the latest version of the state is always kept.
+type CompactionPolicy struct {
+	// Keep that many most recent versions of each state, zero means no limit by count
+	Keep int
+
+	// Keep versions made after that time, zero means no limit by time
+	Since time.Time
+
+	// States to compact - paths to the states, or directories ending with a slash to compact all states in them.
+	// Nothing else in the storage is ever compacted.
+	States []string
+}
+
+// StateCompaction describes how the history of a single state is compacted.
+type StateCompaction struct {
+	// Path to the state in the storage
+	State string
+
+	// How many versions of the state there are, and how many of them are kept
+	Versions, Kept int
+}
+
+// CompactionPlan describes what compacting the history would do.
+type CompactionPlan struct {
+	Policy CompactionPolicy
+
+	// Storage specific revision the plan was made at, i.e. commit hash
+	Revision string
+
+	// States that would lose some of their versions, sorted by the state path
+	States []StateCompaction
+}
+
+// StateHistoryCompactor is an optional interface for StorageClient implementations that can drop old versions from the state history.
+type StateHistoryCompactor interface {
+	// PlanStateHistoryCompaction looks at the history of all states in the storage addressed by current Params set and tells what compacting it would do.
+	// State in Params is not used.
+	PlanStateHistoryCompaction(RequestMetadataParams, CompactionPolicy) (*CompactionPlan, error)
+
+	// CompactStateHistory rewrites the history according to the plan policy.
+	// Caller must hold locks of all states in the plan, and it must fail if any other state would lose versions by now.
+	CompactStateHistory(RequestMetadataParams, *CompactionPlan) (*CompactionPlan, error)
+
+	// ParamsForState makes a copy of Params addressing another state in the same storage, using the same connection.
+	ParamsForState(RequestMetadataParams, string) RequestMetadataParams
+}
+
+// StateMirrorSyncer is an optional interface for StorageClient implementations that keep copies of the storage elsewhere.
+type StateMirrorSyncer interface {
+	// SyncMirrors brings all mirrors of the storage addressed by current Params set up to date, and returns the ones synced.
+	// State in Params is not used.
+	SyncMirrors(RequestMetadataParams) ([]string, error)
+}
+
+// Names of events sent to webhooks
+const (
+	EventLockAcquired = "lock_acquired"
+	EventLockReleased = "lock_released"
+	EventLockConflict = "lock_conflict"
+	EventStateUpdated = "state_updated"
+	EventStateDeleted = "state_deleted"
+)
+
+// Event is a notification about something that happened to the state or it's lock.
+type Event struct {
+	// Name of the event, one of Event* constants
+	Event string `json:"event"`
+
+	// When it happened
+	Time time.Time `json:"time"`
+
+	// Storage type
+	Type string `json:"type"`
+
+	// Storage specific address of the state, see EventDescriber
+	Repository string `json:"repository,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	Directory  string `json:"directory,omitempty"`
+	State      string `json:"state"`
+
+	// Storage specific revision of the change, i.e. commit hash, if there was one
+	Revision string `json:"revision,omitempty"`
+
+	// Lock held on the state, or the one that was requested for lock conflicts
+	LockInfo *LockInfo `json:"lockInfo,omitempty"`
+
+	// Lock held by someone else, for lock conflicts
+	ConflictingLockInfo *LockInfo `json:"conflictingLockInfo,omitempty"`
+}
+
+// EventDescriber is an optional interface for RequestMetadataParams implementations to fill in the address of the state in events.
+type EventDescriber interface {
+	DescribeEvent(*Event)
+}